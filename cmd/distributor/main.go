@@ -22,9 +22,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
 	"github.com/sapcc/netbox-webhook-distributor/pkg/events"
@@ -33,55 +34,99 @@ import (
 
 var opts config.Options
 
+// drainTimeout limits flushing the nats connection after the grace period
+const drainTimeout = 5 * time.Second
+
 func init() {
 	flag.StringVar(&opts.ConfigFilePath, "CONFIG_FILE", "./etc/config.yaml", "Path to the config file")
+	flag.DurationVar(&opts.ConfigReloadInterval, "CONFIG_RELOAD_INTERVAL", 30*time.Second, "Interval to check the config file for changes, 0 disables reloading")
 	flag.IntVar(&opts.LogLevel, "LOG_LEVEL", 1, "Log level")
+	flag.DurationVar(&opts.ShutdownGracePeriod, "SHUTDOWN_GRACE_PERIOD", 20*time.Second, "Time to finish deliveries in progress on shutdown before they are aborted")
+	flag.StringVar(&opts.ListenAddress, "LISTEN_ADDRESS", "0.0.0.0:81", "Address of the metrics, health and admin server")
+	flag.StringVar(&opts.AdminTokenFilePath, "ADMIN_TOKEN_FILE", "", "Path to a file with the bearer token of the admin api, the admin api is disabled without it")
+	opts.Nats.AddFlags()
 	flag.Parse()
+	opts.Nats.SecretsFromEnv()
 }
 
 func main() {
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validate(flag.Args()[1:]))
+	case "render":
+		os.Exit(render(flag.Args()[1:]))
+	}
 	log.SetLevel(opts.LogLevel)
 	ctx, cancel := context.WithCancel(context.Background())
-	natsURL := os.Getenv("NATS_URL")
-	if natsURL == "" {
-		natsURL = nats.DefaultURL
-	}
-	nc, err := nats.Connect(natsURL, nats.MaxReconnects(100))
+	nc, err := events.Connect("netbox-webhook-distributor", opts.Nats)
 	if err != nil {
-		log.Fatal(err)
+		// log.Fatal only logs, without a connection there is nothing to do
+		log.Errorf("connect to nats: %s", err.Error())
+		os.Exit(1)
 	}
 
 	cfg, err := config.GetConfig(opts)
 	if err != nil {
-		log.Fatal(err)
+		// the config is returned even if it is invalid, do not start distributors from it
+		log.Errorf("load config: %s", err.Error())
+		os.Exit(1)
 	}
-	for _, d := range cfg.DistributorList {
-		con, _ := events.NewConsumer(d, nc, ctx)
-		con.Subscribe(ctx)
+	adminToken, err := config.GetAdminToken(opts)
+	if err != nil {
+		log.Errorf("read admin token: %s", err.Error())
+		os.Exit(1)
 	}
+	manager := events.NewManager(nc)
+	manager.Apply(ctx, cfg.DistributorList)
+	go config.WatchConfig(ctx, opts, func(cfg config.Config) {
+		manager.Apply(ctx, cfg.DistributorList)
+	})
+	go manager.RetryFailed(ctx)
+
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.Handler())
+	events.NewAdmin(manager.Consumer, adminToken).RegisterRoutes(router)
+	health := events.NewHealth()
+	health.AddLiveness("nats", events.NatsClosedCheck(nc))
+	health.AddLiveness("distributors", manager.Live)
+	health.AddReadiness("nats_connection", events.NatsConnectedCheck(nc))
+	health.AddReadiness("stream", events.StreamCheck(nc))
+	health.AddReadiness("subscriptions", manager.Ready)
+	health.RegisterRoutes(router)
 
 	srv := &http.Server{
-		Addr: "0.0.0.0:81",
-		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15,
+		Addr: opts.ListenAddress,
+		// no WriteTimeout, replays stream their progress for as long as they take.
 		// https://operations.global.cloud.sap/docs/support/playbook/kubernetes/idle_http_keep_alive_timeout.html
 		ReadTimeout: time.Second * 61,
 		IdleTimeout: time.Second * 61,
-		Handler:     promhttp.Handler(),
+		Handler:     router,
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Error(err)
 		}
 	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	sig := <-c
+	log.Infof("received %s. shutting down", sig)
 	cancel()
-	log.Info("shutting down")
-	os.Exit(0)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), opts.ShutdownGracePeriod)
+	defer cancelShutdown()
+	// stop fetching, let the deliveries in progress finish and nak them after the grace period
+	manager.Shutdown(shutdownCtx)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("shutdown server: %s", err.Error())
+		srv.Close()
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := events.Drain(drainCtx, nc); err != nil {
+		log.Errorf("drain nats connection: %s", err.Error())
+	}
+	log.Info("shut down")
 }
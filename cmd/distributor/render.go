@@ -0,0 +1,102 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/filter"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/transform"
+)
+
+// render runs a sample Netbox webhook through the filter and transform of a distributor
+// and returns the exit code. The rendered body is written to stdout, everything else to stderr.
+// usage: distributor render -config file.yaml -distributor name [-payload sample.json]
+func render(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	path := fs.String("config", opts.ConfigFilePath, "Path to the config file")
+	name := fs.String("distributor", "", "Name of the distributor")
+	payload := fs.String("payload", "-", "Path to a sample Netbox webhook json, - reads stdin")
+	fs.Parse(args)
+
+	cfg, err := config.GetConfig(config.Options{ConfigFilePath: *path})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *path, err.Error())
+		return 1
+	}
+	var d *config.Distributor
+	for i := range cfg.DistributorList {
+		if cfg.DistributorList[i].Name == *name {
+			d = &cfg.DistributorList[i]
+		}
+	}
+	if d == nil {
+		fmt.Fprintf(os.Stderr, "distributor %q not found in %s\n", *name, *path)
+		return 1
+	}
+
+	var data []byte
+	if *payload == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*payload)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read payload: %s\n", err.Error())
+		return 1
+	}
+
+	if d.Filter != "" {
+		f, _ := filter.Parse(d.Filter)
+		ok, err := f.MatchJSON(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "filter: %s\n", err.Error())
+			return 1
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "filter does not match, the event would not be sent\n")
+		}
+	}
+
+	body := data
+	if d.Transform != nil && d.Transform.Template != "" {
+		t, _ := transform.Parse(d.Name, d.Transform.Template)
+		if body, err = t.Execute(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+	}
+
+	headers := []string{"Content-Type: " + d.ContentType()}
+	for k, v := range d.Headers() {
+		headers = append(headers, k+": "+v)
+	}
+	sort.Strings(headers[1:])
+	fmt.Fprintln(os.Stderr, strings.Join(headers, "\n"))
+	if strings.Contains(d.ContentType(), "json") && !json.Valid(body) {
+		fmt.Fprintf(os.Stderr, "warning: content type is %s, but the rendered body is not valid json\n", d.ContentType())
+	}
+	os.Stdout.Write(body)
+	return 0
+}
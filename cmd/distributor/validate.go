@@ -0,0 +1,45 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// validate checks a config file and returns the exit code.
+// usage: distributor validate -config file.yaml
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := fs.String("config", opts.ConfigFilePath, "Path to the config file")
+	resources := fs.Bool("resources", false, "Also read the secrets and TLS files referenced by the config, like the distributor does when it starts")
+	fs.Parse(args)
+
+	cfg, err := config.GetConfig(config.Options{ConfigFilePath: *path})
+	if err == nil && *resources {
+		err = cfg.ValidateResources()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *path, err.Error())
+		return 1
+	}
+	fmt.Printf("%s: config is valid\n", *path)
+	return 0
+}
@@ -18,43 +18,83 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
 	"github.com/sapcc/netbox-webhook-distributor/pkg/events"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/tlsutil"
 	"github.com/siddontang/go/log"
 )
 
 var opts config.Options
 
+// drainTimeout limits flushing the nats connection after the server stopped
+const drainTimeout = 5 * time.Second
+
 func init() {
+	flag.StringVar(&opts.ConfigFilePath, "CONFIG_FILE", "", "Path to the webhook config file, defaults are used if empty")
 	flag.IntVar(&opts.LogLevel, "LOG_LEVEL", 1, "Log level")
+	flag.DurationVar(&opts.ShutdownGracePeriod, "SHUTDOWN_GRACE_PERIOD", 20*time.Second, "Time to finish requests in progress on shutdown")
+	flag.StringVar(&opts.WebhookSecretsFilePath, "WEBHOOK_SECRETS_FILE", "", "Path to a file with Netbox webhook secrets, one per line")
+	flag.StringVar(&opts.ListenAddress, "LISTEN_ADDRESS", "0.0.0.0:80", "Address of the webhook, metrics and health server")
+	flag.StringVar(&opts.TLSCertFile, "TLS_CERT_FILE", "", "Path to the server certificate, enables TLS. Reloaded when it changes")
+	flag.StringVar(&opts.TLSKeyFile, "TLS_KEY_FILE", "", "Path to the key of the server certificate")
+	flag.StringVar(&opts.TLSClientCAFile, "TLS_CLIENT_CA_FILE", "", "Path to a CA bundle, webhooks have to be sent with a client certificate signed by it")
+	opts.Nats.AddFlags()
 	flag.Parse()
+	opts.Nats.SecretsFromEnv()
 }
 
 func main() {
 	log.SetLevel(opts.LogLevel)
-	ctx, cancel := context.WithCancel(context.Background())
-	natsURL := os.Getenv("NATS_URL")
-	if natsURL == "" {
-		natsURL = nats.DefaultURL
+	nc, err := events.Connect("netbox-webhook", opts.Nats)
+	if err != nil {
+		// log.Fatal only logs, without a connection there is nothing to do
+		log.Errorf("connect to nats: %s", err.Error())
+		os.Exit(1)
+	}
+	cfg, err := config.GetWebhookConfig(opts)
+	if err != nil {
+		log.Errorf("load webhook config: %s", err.Error())
+		os.Exit(1)
+	}
+	secrets, err := config.GetWebhookSecrets(opts)
+	if err != nil {
+		// accepting unsigned webhooks because the secrets could not be read would fail open
+		log.Errorf("read webhook secrets: %s", err.Error())
+		os.Exit(1)
 	}
-	nc, err := nats.Connect(natsURL, nats.MaxReconnects(100))
+	p, err := events.NewPublisher(nc, cfg, secrets)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("create publisher: %s", err.Error())
+		os.Exit(1)
 	}
-	p, err := events.NewPublisher(nc)
+
+	p.Router.Handle("/metrics", promhttp.Handler())
+	health := events.NewHealth()
+	health.AddLiveness("nats", events.NatsClosedCheck(nc))
+	health.AddReadiness("nats_connection", events.NatsConnectedCheck(nc))
+	health.AddReadiness("stream", events.StreamCheck(nc))
+	health.RegisterRoutes(p.Router)
+
+	tlsConfig, err := serverTLSConfig(opts)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("configure tls: %s", err.Error())
+		os.Exit(1)
 	}
+	p.RequireClientCert = opts.TLSClientCAFile != ""
 
 	srv := &http.Server{
-		Addr: "0.0.0.0:80",
+		Addr:      opts.ListenAddress,
+		TLSConfig: tlsConfig,
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: time.Second * 15,
 		// https://operations.global.cloud.sap/docs/support/playbook/kubernetes/idle_http_keep_alive_timeout.html
@@ -64,18 +104,61 @@ func main() {
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificate is served by the TLS config
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error(err)
 		}
 	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	<-c
+	sig := <-c
+	log.Infof("received %s. shutting down", sig)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), opts.ShutdownGracePeriod)
+	defer cancelShutdown()
+	// finish the webhooks in progress, so their events are published before the connection is drained
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("shutdown server: %s", err.Error())
+		srv.Close()
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := events.Drain(drainCtx, nc); err != nil {
+		log.Errorf("drain nats connection: %s", err.Error())
+	}
+	log.Info("shut down")
+}
 
-	cancel()
-	srv.Shutdown(ctx)
-	log.Info("shutting down")
-	os.Exit(0)
+// serverTLSConfig serves the certificate of opts, reloaded when its files change. With a client CA,
+// a presented client certificate has to be signed by it. Webhooks without one are rejected by the publisher,
+// so probes and metrics scrapes do not need a client certificate. Without a certificate TLS is disabled.
+func serverTLSConfig(opts config.Options) (*tls.Config, error) {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		if opts.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	certs, err := tlsutil.NewCertReloader(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if opts.TLSClientCAFile != "" {
+		if c.ClientCAs, err = tlsutil.LoadCAPool(opts.TLSClientCAFile); err != nil {
+			return nil, err
+		}
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c, nil
 }
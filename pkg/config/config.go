@@ -19,6 +19,8 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -32,6 +34,294 @@ type Distributor struct {
 	URL            string              `yaml:"url"`
 	Region         string              `yaml:"region"`
 	NetboxWebhooks map[string][]string `yaml:"netbox_webhooks"`
+	// Filter selects the events to distribute, see package filter
+	Filter string `yaml:"filter"`
+	// Transform changes the event before it is sent, by default it is sent as is
+	Transform *Transform `yaml:"transform"`
+	// Sink selects where events are sent to, by default they are posted to URL
+	Sink *Sink `yaml:"sink"`
+	// Retry configures how failed deliveries are retried, unset fields use DefaultRetry
+	Retry *Retry `yaml:"retry"`
+	// Concurrency configures how many events are delivered at the same time
+	Concurrency *Concurrency `yaml:"concurrency"`
+	// Auth authenticates the distributor to the recipient
+	Auth *Auth `yaml:"auth"`
+	// HTTP configures the http client of the http and kafka sinks and of token requests
+	HTTP *HTTPClient `yaml:"http"`
+}
+
+// HTTPClient configures the connections of a distributor, which are pooled and reused
+type HTTPClient struct {
+	TLS *TLS `yaml:"tls"`
+	// Timeout limits a single delivery attempt of any sink
+	Timeout             time.Duration `yaml:"timeout"`
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// IdleConnTimeout closes idle connections, MaxIdleConnsPerHost limits the idle connections kept
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	DisableKeepAlives   bool          `yaml:"disable_keep_alives"`
+	// ProxyURL is used for all requests, by default HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used
+	ProxyURL string `yaml:"proxy_url"`
+}
+
+// TLS configures the connections to a recipient
+type TLS struct {
+	// CAFile is a PEM bundle of the CAs trusted in addition to the system CAs
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate, reloaded when the files change
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, 1.2 by default
+	MinVersion string `yaml:"min_version"`
+	// ServerName is verified instead of the host of the url
+	ServerName string `yaml:"server_name"`
+	// InsecureSkipVerify disables the verification of the server certificate, only meant for labs
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// DefaultHTTPClient is used for all http client settings not configured
+var DefaultHTTPClient = HTTPClient{
+	Timeout:             5 * time.Second,
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConnsPerHost: 8,
+}
+
+// Auth configures how the distributor authenticates to the recipient. Secrets are read from files or env variables.
+type Auth struct {
+	HMAC   *HMACAuth  `yaml:"hmac"`
+	Bearer *SecretRef `yaml:"bearer"`
+	Basic  *BasicAuth `yaml:"basic"`
+	// OAuth2 and Keystone fetch a token, which is cached until it expires
+	OAuth2   *OAuth2Auth   `yaml:"oauth2"`
+	Keystone *KeystoneAuth `yaml:"keystone"`
+	// Headers are additional headers with secret values, e.g. an api key
+	Headers map[string]SecretRef `yaml:"headers"`
+}
+
+// OAuth2Auth fetches a token with the OAuth2 client credentials grant and sends it as bearer token
+type OAuth2Auth struct {
+	TokenURL     string    `yaml:"token_url"`
+	ClientID     string    `yaml:"client_id"`
+	ClientSecret SecretRef `yaml:"client_secret"`
+	Scopes       []string  `yaml:"scopes"`
+}
+
+// KeystoneAuth fetches an OpenStack Keystone v3 token and sends it in X-Auth-Token.
+// It authenticates with an application credential or with a password scoped to a project.
+type KeystoneAuth struct {
+	// AuthURL of the identity v3 api, e.g. https://identity.example.com/v3
+	AuthURL                     string     `yaml:"auth_url"`
+	ApplicationCredentialID     string     `yaml:"application_credential_id"`
+	ApplicationCredentialSecret *SecretRef `yaml:"application_credential_secret"`
+	Username                    string     `yaml:"username"`
+	UserDomainName              string     `yaml:"user_domain_name"`
+	Password                    *SecretRef `yaml:"password"`
+	ProjectID                   string     `yaml:"project_id"`
+	ProjectName                 string     `yaml:"project_name"`
+	ProjectDomainName           string     `yaml:"project_domain_name"`
+}
+
+// HMACAuth signs every event. Without Timestamp the signature is the one Netbox sends:
+// the hex encoded HMAC of the body in the X-Hook-Signature header.
+type HMACAuth struct {
+	// Algorithm is sha256 or sha512, sha512 by default
+	Algorithm string `yaml:"algorithm"`
+	// Header holding the signature, X-Hook-Signature by default
+	Header string    `yaml:"header"`
+	Secret SecretRef `yaml:"secret"`
+	// Timestamp sends the time of signing in X-Hook-Timestamp and signs "<timestamp>.<body>",
+	// so recipients can reject replayed requests
+	Timestamp bool `yaml:"timestamp"`
+}
+
+// hmac algorithms
+const (
+	HMACSHA256 = "sha256"
+	HMACSHA512 = "sha512"
+)
+
+type BasicAuth struct {
+	Username string    `yaml:"username"`
+	Password SecretRef `yaml:"password"`
+}
+
+// Concurrency of the deliveries of a distributor. Events are partitioned by the id of their Netbox object,
+// events of the same object are delivered in order with in-process retries. In redelivery mode a nak'ed event
+// is overtaken by the later events of the same object.
+type Concurrency struct {
+	// Workers deliver the events of each object type, 1 by default
+	Workers int `yaml:"workers"`
+	// Batch is the number of events fetched at once, Workers by default
+	Batch int `yaml:"batch"`
+}
+
+// Retry is the backoff of a distributor. The delay starts at Base and is multiplied by Factor after every attempt.
+type Retry struct {
+	// Mode is inprocess or redelivery, see RetryRedelivery
+	Mode string `yaml:"mode"`
+	// Steps is the maximum number of attempts
+	Steps  int           `yaml:"steps"`
+	Base   time.Duration `yaml:"base"`
+	Factor float64       `yaml:"factor"`
+	// Jitter adds up to Jitter * delay to every delay
+	Jitter float64 `yaml:"jitter"`
+	// MaxDelay caps a single delay, including a Retry-After of the recipient.
+	// In inprocess mode it has to stay below the ack wait of 30s, otherwise the event is redelivered while waiting.
+	// MaxDuration caps the time spent retrying an event, 0 is unlimited.
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// StatusCodes are the http status codes which are retried
+	StatusCodes []int `yaml:"status_codes"`
+}
+
+// retry modes
+const (
+	// RetryInProcess retries while keeping the event in progress, events are delivered in order
+	RetryInProcess = "inprocess"
+	// RetryRedelivery naks failed events with the delay, JetStream redelivers them.
+	// Retries survive restarts and can span hours, but events are no longer delivered in order.
+	RetryRedelivery = "redelivery"
+)
+
+// DefaultRetry is used for all retry settings not configured
+var DefaultRetry = Retry{
+	Mode:        RetryInProcess,
+	Steps:       50,
+	Base:        50 * time.Millisecond,
+	Factor:      1.1,
+	Jitter:      0.1,
+	MaxDelay:    20 * time.Second,
+	StatusCodes: []int{429, 500, 502, 503, 504},
+}
+
+// sink types
+const (
+	SinkHTTP      = "http"
+	SinkNATS      = "nats"
+	SinkJetStream = "jetstream"
+	SinkKafka     = "kafka"
+	SinkFile      = "file"
+	SinkStdout    = "stdout"
+)
+
+type Sink struct {
+	Type string `yaml:"type"`
+	// Subject to publish to for the nats and jetstream sinks
+	Subject string `yaml:"subject"`
+	// URL of the Kafka REST proxy and the Topic to produce to for the kafka sink
+	URL   string `yaml:"url"`
+	Topic string `yaml:"topic"`
+	// Path of the file the file sink appends to
+	Path string `yaml:"path"`
+}
+
+type Transform struct {
+	// Template is a text/template executed with the webhook json, see package transform
+	Template    string            `yaml:"template"`
+	ContentType string            `yaml:"content_type"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+// SinkType returns the configured sink type, http if none is configured
+func (d Distributor) SinkType() string {
+	if d.Sink == nil || d.Sink.Type == "" {
+		return SinkHTTP
+	}
+	return d.Sink.Type
+}
+
+// ContentType of the events sent to the recipient
+func (d Distributor) ContentType() string {
+	if d.Transform != nil && d.Transform.ContentType != "" {
+		return d.Transform.ContentType
+	}
+	return "application/json"
+}
+
+// Headers are the additional http headers sent to the recipient
+func (d Distributor) Headers() map[string]string {
+	if d.Transform == nil {
+		return nil
+	}
+	return d.Transform.Headers
+}
+
+// RetryPolicy returns the retry settings of the distributor, completed with DefaultRetry
+func (d Distributor) RetryPolicy() Retry {
+	r := DefaultRetry
+	if d.Retry == nil {
+		return r
+	}
+	if d.Retry.Mode != "" {
+		r.Mode = d.Retry.Mode
+	}
+	if d.Retry.Steps != 0 {
+		r.Steps = d.Retry.Steps
+	}
+	if d.Retry.Base != 0 {
+		r.Base = d.Retry.Base
+	}
+	if d.Retry.Factor != 0 {
+		r.Factor = d.Retry.Factor
+	}
+	if d.Retry.Jitter != 0 {
+		r.Jitter = d.Retry.Jitter
+	}
+	if d.Retry.MaxDelay != 0 {
+		r.MaxDelay = d.Retry.MaxDelay
+	}
+	r.MaxDuration = d.Retry.MaxDuration
+	if d.Retry.StatusCodes != nil {
+		r.StatusCodes = d.Retry.StatusCodes
+	}
+	return r
+}
+
+// ConcurrencyConfig returns the concurrency of the distributor, by default one event is delivered at a time
+func (d Distributor) ConcurrencyConfig() Concurrency {
+	c := Concurrency{Workers: 1}
+	if d.Concurrency == nil {
+		c.Batch = c.Workers
+		return c
+	}
+	if d.Concurrency.Workers > 0 {
+		c.Workers = d.Concurrency.Workers
+	}
+	c.Batch = d.Concurrency.Batch
+	if c.Batch <= 0 {
+		c.Batch = c.Workers
+	}
+	return c
+}
+
+// HTTPClientConfig returns the http client settings of the distributor, completed with DefaultHTTPClient
+func (d Distributor) HTTPClientConfig() HTTPClient {
+	c := DefaultHTTPClient
+	if d.HTTP == nil {
+		return c
+	}
+	c.TLS = d.HTTP.TLS
+	if d.HTTP.Timeout != 0 {
+		c.Timeout = d.HTTP.Timeout
+	}
+	if d.HTTP.DialTimeout != 0 {
+		c.DialTimeout = d.HTTP.DialTimeout
+	}
+	if d.HTTP.TLSHandshakeTimeout != 0 {
+		c.TLSHandshakeTimeout = d.HTTP.TLSHandshakeTimeout
+	}
+	if d.HTTP.IdleConnTimeout != 0 {
+		c.IdleConnTimeout = d.HTTP.IdleConnTimeout
+	}
+	if d.HTTP.MaxIdleConnsPerHost != 0 {
+		c.MaxIdleConnsPerHost = d.HTTP.MaxIdleConnsPerHost
+	}
+	c.DisableKeepAlives = d.HTTP.DisableKeepAlives
+	c.ProxyURL = d.HTTP.ProxyURL
+	return c
 }
 
 func GetConfig(opts Options) (cfg Config, err error) {
@@ -42,10 +332,47 @@ func GetConfig(opts Options) (cfg Config, err error) {
 	if err != nil {
 		return cfg, fmt.Errorf("read file file: %s", err.Error())
 	}
-	err = yaml.Unmarshal(yamlBytes, &cfg)
+	err = yaml.UnmarshalStrict(yamlBytes, &cfg)
 	if err != nil {
 		return cfg, fmt.Errorf("parse config file: %s", err.Error())
 	}
 
-	return cfg, nil
+	return cfg, cfg.Validate()
+}
+
+// GetWebhookSecrets reads the Netbox webhook secrets file.
+// It holds one secret per line, several secrets can be active while rotating them.
+func GetWebhookSecrets(opts Options) (secrets []string, err error) {
+	if opts.WebhookSecretsFilePath == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(opts.WebhookSecretsFilePath)
+	if err != nil {
+		return secrets, fmt.Errorf("read secrets file: %s", err.Error())
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			secrets = append(secrets, l)
+		}
+	}
+	if len(secrets) == 0 {
+		return secrets, fmt.Errorf("secrets file %s does not contain any secret", opts.WebhookSecretsFilePath)
+	}
+	return
+}
+
+// GetAdminToken reads the bearer token of the admin api, it is empty if no file is configured
+func GetAdminToken(opts Options) (string, error) {
+	if opts.AdminTokenFilePath == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(opts.AdminTokenFilePath)
+	if err != nil {
+		return "", fmt.Errorf("read admin token file: %s", err.Error())
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", opts.AdminTokenFilePath)
+	}
+	return token, nil
 }
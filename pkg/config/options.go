@@ -15,9 +15,94 @@
  */
 package config
 
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
 // Options passed via cmd line
 type Options struct {
-	Version        string
-	ConfigFilePath string
-	LogLevel       int
+	Version              string
+	ConfigFilePath       string
+	ConfigReloadInterval time.Duration
+	LogLevel             int
+	ShutdownGracePeriod  time.Duration
+	ListenAddress        string
+	// AdminTokenFilePath is a file with the bearer token of the admin api
+	AdminTokenFilePath string
+
+	WebhookSecretsFilePath string
+	// TLSCertFile and TLSKeyFile enable TLS on the webhook listener, TLSClientCAFile verifies client certificates
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	Nats NatsOptions
+}
+
+// NatsOptions configure the Nats connection. At most one of user and password, token, nkey seed and credentials is used.
+type NatsOptions struct {
+	URL      string
+	User     string
+	Password string
+	Token    string
+	// NKeySeedFile authenticates with the nkey of the seed
+	NKeySeedFile string
+	// CredentialsFile is a .creds file with the user JWT and nkey seed
+	CredentialsFile string
+	// CAFile is trusted in addition to the system CAs, CertFile and KeyFile are the client certificate
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// AddFlags adds the flags of the Nats connection. They default to the environment variables
+// of the same name, so secrets do not have to be passed on the command line.
+// The secrets are not used as defaults, which are printed in the usage, call SecretsFromEnv after parsing.
+func (o *NatsOptions) AddFlags() {
+	flag.StringVar(&o.URL, "NATS_URL", envOr("NATS_URL", "nats://127.0.0.1:4222"), "Nats server urls, comma separated")
+	flag.StringVar(&o.User, "NATS_USER", os.Getenv("NATS_USER"), "Nats user")
+	flag.StringVar(&o.Password, "NATS_PASSWORD", "", "Nats password, defaults to the env variable NATS_PASSWORD")
+	flag.StringVar(&o.Token, "NATS_TOKEN", "", "Nats token, defaults to the env variable NATS_TOKEN")
+	flag.StringVar(&o.NKeySeedFile, "NATS_NKEY_SEED_FILE", os.Getenv("NATS_NKEY_SEED_FILE"), "Path to a Nats nkey seed file")
+	flag.StringVar(&o.CredentialsFile, "NATS_CREDS_FILE", os.Getenv("NATS_CREDS_FILE"), "Path to a Nats credentials file with user JWT and seed")
+	flag.StringVar(&o.CAFile, "NATS_CA_FILE", os.Getenv("NATS_CA_FILE"), "Path to a CA bundle to verify the Nats server")
+	flag.StringVar(&o.CertFile, "NATS_CERT_FILE", os.Getenv("NATS_CERT_FILE"), "Path to the client certificate for Nats")
+	flag.StringVar(&o.KeyFile, "NATS_KEY_FILE", os.Getenv("NATS_KEY_FILE"), "Path to the key of the client certificate for Nats")
+}
+
+// SecretsFromEnv sets the password and token not passed as flags from their environment variables
+func (o *NatsOptions) SecretsFromEnv() {
+	if o.Password == "" {
+		o.Password = os.Getenv("NATS_PASSWORD")
+	}
+	if o.Token == "" {
+		o.Token = os.Getenv("NATS_TOKEN")
+	}
+}
+
+// Validate checks that at most one authentication is configured and the client certificate is complete
+func (o NatsOptions) Validate() error {
+	auths := 0
+	for _, set := range []bool{o.User != "" || o.Password != "", o.Token != "", o.NKeySeedFile != "", o.CredentialsFile != ""} {
+		if set {
+			auths++
+		}
+	}
+	if auths > 1 {
+		return fmt.Errorf("only one of nats user and password, token, nkey seed and credentials can be used")
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("nats needs both cert file and key file")
+	}
+	return nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
 }
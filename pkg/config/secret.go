@@ -0,0 +1,60 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SecretRef references a secret kept out of the config file, in a file or an environment variable
+type SecretRef struct {
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// Value reads the secret. Trailing newlines of files are removed.
+func (s SecretRef) Value() (string, error) {
+	if err := s.validate(); err != nil {
+		return "", err
+	}
+	if s.File != "" {
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("read secret file: %s", err.Error())
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	v, ok := os.LookupEnv(s.Env)
+	if !ok {
+		return "", fmt.Errorf("secret env variable %s is not set", s.Env)
+	}
+	return v, nil
+}
+
+// validate checks exactly one source is set, without reading the secret
+func (s SecretRef) validate() error {
+	switch {
+	case s.File != "" && s.Env != "":
+		return fmt.Errorf("secret must be read from either a file or an env variable")
+	case s.File == "" && s.Env == "":
+		return fmt.Errorf("secret has neither a file nor an env variable")
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/filter"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/tlsutil"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/transform"
+)
+
+// Events sent by Netbox webhooks
+var NetboxEvents = []string{"created", "updated", "deleted"}
+
+// NetboxModels are the object types Netbox sends webhooks for, as found in the model field of the webhook
+var NetboxModels = []string{
+	// circuits
+	"circuit", "circuittermination", "circuittype", "provider", "providernetwork",
+	// dcim
+	"cable", "consoleport", "consoleporttemplate", "consoleserverport", "consoleserverporttemplate",
+	"device", "devicebay", "devicebaytemplate", "devicerole", "devicetype", "frontport", "frontporttemplate",
+	"interface", "interfacetemplate", "inventoryitem", "inventoryitemrole", "inventoryitemtemplate",
+	"location", "manufacturer", "module", "modulebay", "modulebaytemplate", "moduletype", "platform",
+	"powerfeed", "poweroutlet", "poweroutlettemplate", "powerpanel", "powerport", "powerporttemplate",
+	"rack", "rackreservation", "rackrole", "rearport", "rearporttemplate", "region", "site", "sitegroup",
+	"virtualchassis",
+	// extras
+	"journalentry", "tag",
+	// ipam
+	"aggregate", "asn", "fhrpgroup", "fhrpgroupassignment", "ipaddress", "iprange", "prefix", "rir", "role",
+	"routetarget", "service", "servicetemplate", "vlan", "vlangroup", "vrf",
+	// tenancy
+	"contact", "contactassignment", "contactgroup", "contactrole", "tenant", "tenantgroup",
+	// virtualization
+	"cluster", "clustergroup", "clustertype", "virtualmachine", "vminterface",
+	// wireless
+	"wirelesslan", "wirelesslangroup", "wirelesslink",
+}
+
+// names end up in Nats subjects and durable consumer names,
+// which must not contain whitespace, ".", "*" or ">".
+var natsNameRx = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidationError lists all problems found in a config
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(v, "\n  ")
+}
+
+func (v *ValidationError) add(format string, a ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, a...))
+}
+
+// Validate checks the config for mistakes, which would otherwise result in a distributor silently not sending anything
+func (c Config) Validate() error {
+	var errs ValidationError
+	names := make(map[string]bool, len(c.DistributorList))
+	for i, d := range c.DistributorList {
+		prefix := fmt.Sprintf("distributor_list[%d]", i)
+		if d.Name != "" {
+			prefix = fmt.Sprintf("distributor %q", d.Name)
+		}
+		switch {
+		case d.Name == "":
+			errs.add("%s: name is missing", prefix)
+		case !natsNameRx.MatchString(d.Name):
+			errs.add("%s: name may only contain letters, digits, '-' and '_'", prefix)
+		case names[d.Name]:
+			errs.add("%s: name is used more than once", prefix)
+		}
+		names[d.Name] = true
+
+		if d.Region == "" {
+			errs.add("%s: region is missing", prefix)
+		} else if !natsNameRx.MatchString(d.Region) {
+			errs.add("%s: region may only contain letters, digits, '-' and '_'", prefix)
+		}
+
+		switch d.SinkType() {
+		case SinkHTTP:
+			validateURL(&errs, prefix, "url", d.URL)
+		case SinkNATS, SinkJetStream:
+			if d.Sink.Subject == "" || strings.ContainsAny(d.Sink.Subject, " \t*>") {
+				errs.add("%s: sink subject %q must be a nats subject without wildcards", prefix, d.Sink.Subject)
+			}
+		case SinkKafka:
+			validateURL(&errs, prefix, "sink url", d.Sink.URL)
+			if d.Sink.Topic == "" {
+				errs.add("%s: sink topic is missing", prefix)
+			}
+		case SinkFile:
+			if d.Sink.Path == "" {
+				errs.add("%s: sink path is missing", prefix)
+			}
+		case SinkStdout:
+		default:
+			errs.add("%s: unknown sink type %q", prefix, d.Sink.Type)
+		}
+
+		if len(d.NetboxWebhooks) == 0 {
+			errs.add("%s: netbox_webhooks is empty", prefix)
+		}
+		for _, model := range sortedKeys(d.NetboxWebhooks) {
+			if !contains(NetboxModels, model) {
+				errs.add("%s: unknown netbox model %q", prefix, model)
+			}
+			if len(d.NetboxWebhooks[model]) == 0 {
+				errs.add("%s: no events configured for %q", prefix, model)
+			}
+			for _, e := range d.NetboxWebhooks[model] {
+				if !contains(NetboxEvents, e) {
+					errs.add("%s: unknown event %q for %q, expected one of %s", prefix, e, model, strings.Join(NetboxEvents, ", "))
+				}
+			}
+		}
+		if d.Filter != "" {
+			if _, err := filter.Parse(d.Filter); err != nil {
+				errs.add("%s: %s", prefix, err.Error())
+			}
+		}
+		if d.Retry != nil {
+			validateRetry(&errs, prefix, *d.Retry)
+		}
+		if d.Auth != nil {
+			// other sinks would copy credentials into message headers readable by every subscriber, or drop them
+			if d.SinkType() != SinkHTTP {
+				errs.add("%s: auth is only supported by the %s sink", prefix, SinkHTTP)
+			}
+			validateAuth(&errs, prefix, *d.Auth)
+		}
+		if d.HTTP != nil {
+			validateHTTPClient(&errs, prefix, *d.HTTP)
+		}
+		if d.Concurrency != nil && (d.Concurrency.Workers < 0 || d.Concurrency.Batch < 0) {
+			errs.add("%s: concurrency workers and batch must not be negative", prefix)
+		}
+		if d.Transform != nil && d.Transform.Template != "" {
+			if _, err := transform.Parse(d.Name, d.Transform.Template); err != nil {
+				errs.add("%s: %s", prefix, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateAuth(errs *ValidationError, prefix string, a Auth) {
+	modes := 0
+	for _, set := range []bool{a.Bearer != nil, a.Basic != nil, a.OAuth2 != nil, a.Keystone != nil} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		errs.add("%s: auth can use only one of bearer, basic, oauth2 and keystone", prefix)
+	}
+	if a.OAuth2 != nil {
+		validateURL(errs, prefix, "auth oauth2 token_url", a.OAuth2.TokenURL)
+		if a.OAuth2.ClientID == "" {
+			errs.add("%s: auth oauth2 client_id is missing", prefix)
+		}
+	}
+	if k := a.Keystone; k != nil {
+		validateURL(errs, prefix, "auth keystone auth_url", k.AuthURL)
+		switch {
+		case k.ApplicationCredentialID != "":
+			if k.ApplicationCredentialSecret == nil {
+				errs.add("%s: auth keystone application_credential_secret is missing", prefix)
+			}
+		case k.Username != "":
+			if k.UserDomainName == "" {
+				errs.add("%s: auth keystone user_domain_name is missing", prefix)
+			}
+			if k.Password == nil {
+				errs.add("%s: auth keystone password is missing", prefix)
+			}
+			if k.ProjectID == "" && (k.ProjectName == "" || k.ProjectDomainName == "") {
+				errs.add("%s: auth keystone needs project_id or project_name and project_domain_name", prefix)
+			}
+		default:
+			errs.add("%s: auth keystone needs application_credential_id or username", prefix)
+		}
+	}
+	if a.HMAC != nil {
+		if a.HMAC.Algorithm != "" && a.HMAC.Algorithm != HMACSHA256 && a.HMAC.Algorithm != HMACSHA512 {
+			errs.add("%s: auth hmac algorithm must be %s or %s", prefix, HMACSHA256, HMACSHA512)
+		}
+	}
+	if a.Basic != nil && a.Basic.Username == "" {
+		errs.add("%s: auth basic username is missing", prefix)
+	}
+	secrets := a.secrets()
+	for _, field := range sortedSecretKeys(secrets) {
+		validateSecret(errs, prefix, field, secrets[field])
+	}
+}
+
+// secrets returns the secrets of the auth config by field name
+func (a Auth) secrets() map[string]SecretRef {
+	s := make(map[string]SecretRef)
+	if a.HMAC != nil {
+		s["auth hmac secret"] = a.HMAC.Secret
+	}
+	if a.Bearer != nil {
+		s["auth bearer"] = *a.Bearer
+	}
+	if a.Basic != nil {
+		s["auth basic password"] = a.Basic.Password
+	}
+	if a.OAuth2 != nil {
+		s["auth oauth2 client_secret"] = a.OAuth2.ClientSecret
+	}
+	if k := a.Keystone; k != nil {
+		if k.ApplicationCredentialSecret != nil {
+			s["auth keystone application_credential_secret"] = *k.ApplicationCredentialSecret
+		}
+		if k.Password != nil {
+			s["auth keystone password"] = *k.Password
+		}
+	}
+	for h, ref := range a.Headers {
+		s[fmt.Sprintf("auth header %s", h)] = ref
+	}
+	return s
+}
+
+// validateSecret checks the secret has exactly one source, it is not read
+func validateSecret(errs *ValidationError, prefix, field string, s SecretRef) {
+	if err := s.validate(); err != nil {
+		errs.add("%s: %s: %s", prefix, field, err.Error())
+	}
+}
+
+// ValidateResources reads the secrets and TLS files referenced by the config. Validate only checks the structure,
+// so a config can be validated in CI where they are not available.
+func (c Config) ValidateResources() error {
+	var errs ValidationError
+	for i, d := range c.DistributorList {
+		prefix := fmt.Sprintf("distributor_list[%d]", i)
+		if d.Name != "" {
+			prefix = fmt.Sprintf("distributor %q", d.Name)
+		}
+		if d.Auth != nil {
+			secrets := d.Auth.secrets()
+			for _, field := range sortedSecretKeys(secrets) {
+				if _, err := secrets[field].Value(); err != nil {
+					errs.add("%s: %s: %s", prefix, field, err.Error())
+				}
+			}
+		}
+		if d.HTTP != nil && d.HTTP.TLS != nil {
+			t := d.HTTP.TLS
+			if t.CAFile != "" {
+				if _, err := tlsutil.LoadCAPool(t.CAFile); err != nil {
+					errs.add("%s: http tls: %s", prefix, err.Error())
+				}
+			}
+			if t.CertFile != "" && t.KeyFile != "" {
+				if _, err := tlsutil.NewCertReloader(t.CertFile, t.KeyFile); err != nil {
+					errs.add("%s: http tls: %s", prefix, err.Error())
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateHTTPClient(errs *ValidationError, prefix string, h HTTPClient) {
+	if h.Timeout < 0 || h.DialTimeout < 0 || h.TLSHandshakeTimeout < 0 || h.IdleConnTimeout < 0 {
+		errs.add("%s: http timeouts must not be negative", prefix)
+	}
+	if h.MaxIdleConnsPerHost < 0 {
+		errs.add("%s: http max_idle_conns_per_host must not be negative", prefix)
+	}
+	if h.ProxyURL != "" {
+		validateURL(errs, prefix, "http proxy_url", h.ProxyURL)
+	}
+	if t := h.TLS; t != nil {
+		if _, err := tlsutil.ParseVersion(t.MinVersion); err != nil {
+			errs.add("%s: http tls: %s", prefix, err.Error())
+		}
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			errs.add("%s: http tls needs both cert_file and key_file", prefix)
+		}
+	}
+}
+
+func validateRetry(errs *ValidationError, prefix string, r Retry) {
+	if r.Mode != "" && r.Mode != RetryInProcess && r.Mode != RetryRedelivery {
+		errs.add("%s: retry mode must be %s or %s", prefix, RetryInProcess, RetryRedelivery)
+	}
+	if r.Steps < 0 {
+		errs.add("%s: retry steps must not be negative", prefix)
+	}
+	if r.Base < 0 || r.MaxDelay < 0 || r.MaxDuration < 0 {
+		errs.add("%s: retry durations must not be negative", prefix)
+	}
+	if r.Mode != RetryRedelivery && r.MaxDelay >= 30*time.Second {
+		errs.add("%s: retry max_delay must be less than the ack wait of 30s", prefix)
+	}
+	if r.Factor != 0 && r.Factor < 1 {
+		errs.add("%s: retry factor must be at least 1", prefix)
+	}
+	if r.Jitter < 0 {
+		errs.add("%s: retry jitter must not be negative", prefix)
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			errs.add("%s: invalid retry status code %d", prefix, code)
+		}
+	}
+}
+
+func validateURL(errs *ValidationError, prefix, field, value string) {
+	if value == "" {
+		errs.add("%s: %s is missing", prefix, field)
+	} else if u, err := url.Parse(value); err != nil {
+		errs.add("%s: invalid %s: %s", prefix, field, err.Error())
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add("%s: %s %q must be an absolute http or https url", prefix, field, value)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedSecretKeys(m map[string]SecretRef) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	"github.com/siddontang/go/log"
+)
+
+// WatchConfig polls the config file and calls onChange whenever its content changed.
+// Comparing the content instead of file events also catches Kubernetes ConfigMap
+// updates, which swap a symlink to a new directory.
+// An invalid config is logged and ignored, the previous config stays in use.
+func WatchConfig(ctx context.Context, opts Options, onChange func(Config)) {
+	if opts.ConfigFilePath == "" || opts.ConfigReloadInterval <= 0 {
+		return
+	}
+	last := fileHash(opts.ConfigFilePath)
+	ticker := time.NewTicker(opts.ConfigReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h := fileHash(opts.ConfigFilePath)
+		if h == nil || bytes.Equal(h, last) {
+			continue
+		}
+		last = h
+		cfg, err := GetConfig(opts)
+		if err != nil {
+			log.Errorf("config file changed but is invalid, keeping the current config: %s", err.Error())
+			continue
+		}
+		log.Infof("config file %s changed. reloading", opts.ConfigFilePath)
+		onChange(cfg)
+	}
+}
+
+func fileHash(path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Errorf("read config file: %s", err.Error())
+		return nil
+	}
+	h := sha256.Sum256(b)
+	return h[:]
+}
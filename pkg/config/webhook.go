@@ -0,0 +1,207 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// WebhookConfig configures the webhook, which receives the Netbox webhooks
+type WebhookConfig struct {
+	Regions       RegionConfig        `yaml:"regions"`
+	Stream        StreamConfig        `yaml:"stream"`
+	Deduplication DeduplicationConfig `yaml:"deduplication"`
+	// MaxBodySize is the maximum size of a webhook in bytes, larger webhooks are rejected
+	MaxBodySize int64 `yaml:"max_body_size"`
+}
+
+// DefaultMaxBodySize is used if max_body_size is not configured
+const DefaultMaxBodySize = 1 << 20
+
+// DeduplicationConfig configures how the id of an event is derived.
+// JetStream drops events with an id already seen within the duplicate_window of the stream.
+type DeduplicationConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Fields are dotted paths into the webhook json hashed into the event id.
+	// The special field body hashes the complete webhook.
+	Fields []string `yaml:"fields"`
+}
+
+// DeduplicationBody is the field hashing the complete webhook
+const DeduplicationBody = "body"
+
+// DefaultDeduplicationFields identify a webhook sent by Netbox, including its retries
+var DefaultDeduplicationFields = []string{"request_id", "model", "data.id", "event", "timestamp"}
+
+// StreamConfig configures the NETBOX JetStream stream, which keeps the events
+type StreamConfig struct {
+	// MaxAge is the time events are kept, 0 keeps them until another limit is reached.
+	// It is a pointer to tell an explicit 0 from a missing max_age, which uses the default.
+	MaxAge *time.Duration `yaml:"max_age"`
+	// MaxBytes and MaxMsgsPerSubject limit the size of the stream, -1 is unlimited
+	MaxBytes          int64 `yaml:"max_bytes"`
+	MaxMsgsPerSubject int64 `yaml:"max_msgs_per_subject"`
+	Replicas          int   `yaml:"replicas"`
+	// Storage is file or memory
+	Storage string `yaml:"storage"`
+	// Discard is old or new, it decides which events are dropped when a limit is reached
+	Discard string `yaml:"discard"`
+	// DuplicateWindow is the time in which events with the same id are deduplicated
+	DuplicateWindow time.Duration `yaml:"duplicate_window"`
+}
+
+// stream settings
+const (
+	StorageFile   = "file"
+	StorageMemory = "memory"
+	DiscardOld    = "old"
+	DiscardNew    = "new"
+)
+
+// DefaultStreamConfig is used for all stream settings not configured
+var DefaultStreamConfig = StreamConfig{
+	MaxAge:            durationPtr(1 * time.Hour),
+	MaxBytes:          -1,
+	MaxMsgsPerSubject: -1,
+	Replicas:          1,
+	Storage:           StorageFile,
+	Discard:           DiscardOld,
+	DuplicateWindow:   2 * time.Minute,
+}
+
+// RegionConfig configures how the region of an event is derived.
+// The sources are tried in order: sites, rules, netbox_region and finally the fallback.
+type RegionConfig struct {
+	// Sites maps site slugs to regions
+	Sites map[string]string `yaml:"sites"`
+	// Rules are regular expressions matched against the site slug.
+	// The region is the group named region, the first group or the whole match.
+	Rules []string `yaml:"rules"`
+	// NetboxRegion uses the slug of the Netbox region found in the webhook (data.site.region or data.region)
+	NetboxRegion bool `yaml:"netbox_region"`
+	// Fallback is the region of events which could not be resolved, e.g. objects without a site
+	Fallback string `yaml:"fallback"`
+	// RejectUnresolved rejects events which could not be resolved instead of using the fallback
+	RejectUnresolved bool `yaml:"reject_unresolved"`
+}
+
+// DefaultRegionRules derive the region from site slugs like qa-de-1a or qa-de-1ab
+var DefaultRegionRules = []string{`^(?P<region>[a-z]{2}-[a-z]{2}-\d+)[a-z]*$`}
+
+// DefaultRegionFallback is used for events without a resolvable region
+const DefaultRegionFallback = "global"
+
+// GetWebhookConfig reads the webhook config file. Without a file the defaults are used.
+func GetWebhookConfig(opts Options) (cfg WebhookConfig, err error) {
+	if opts.ConfigFilePath != "" {
+		yamlBytes, err := ioutil.ReadFile(opts.ConfigFilePath)
+		if err != nil {
+			return cfg, fmt.Errorf("read config file: %s", err.Error())
+		}
+		if err = yaml.UnmarshalStrict(yamlBytes, &cfg); err != nil {
+			return cfg, fmt.Errorf("parse config file: %s", err.Error())
+		}
+	}
+	if cfg.Regions.Rules == nil {
+		cfg.Regions.Rules = DefaultRegionRules
+	}
+	if cfg.Regions.Fallback == "" && !cfg.Regions.RejectUnresolved {
+		cfg.Regions.Fallback = DefaultRegionFallback
+	}
+	cfg.Stream.setDefaults()
+	if len(cfg.Deduplication.Fields) == 0 {
+		cfg.Deduplication.Fields = DefaultDeduplicationFields
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	return cfg, cfg.Validate()
+}
+
+func (s *StreamConfig) setDefaults() {
+	d := DefaultStreamConfig
+	if s.MaxAge == nil {
+		s.MaxAge = durationPtr(*d.MaxAge)
+	}
+	if s.MaxBytes == 0 {
+		s.MaxBytes = d.MaxBytes
+	}
+	if s.MaxMsgsPerSubject == 0 {
+		s.MaxMsgsPerSubject = d.MaxMsgsPerSubject
+	}
+	if s.Replicas == 0 {
+		s.Replicas = d.Replicas
+	}
+	if s.Storage == "" {
+		s.Storage = d.Storage
+	}
+	if s.Discard == "" {
+		s.Discard = d.Discard
+	}
+	if s.DuplicateWindow == 0 {
+		s.DuplicateWindow = d.DuplicateWindow
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+// Validate checks the webhook config
+func (c WebhookConfig) Validate() error {
+	var errs ValidationError
+	for site, region := range c.Regions.Sites {
+		if !natsNameRx.MatchString(region) {
+			errs.add("regions: region %q of site %q may only contain letters, digits, '-' and '_'", region, site)
+		}
+	}
+	for _, r := range c.Regions.Rules {
+		if _, err := regexp.Compile(r); err != nil {
+			errs.add("regions: invalid rule %q: %s", r, err.Error())
+		}
+	}
+	if c.Regions.Fallback != "" && !natsNameRx.MatchString(c.Regions.Fallback) {
+		errs.add("regions: fallback %q may only contain letters, digits, '-' and '_'", c.Regions.Fallback)
+	}
+	if c.MaxBodySize < 0 {
+		errs.add("max_body_size must not be negative")
+	}
+	if c.Stream.MaxAge != nil && *c.Stream.MaxAge < 0 {
+		errs.add("stream: max_age must not be negative")
+	}
+	if c.Stream.Replicas < 1 || c.Stream.Replicas > 5 {
+		errs.add("stream: replicas must be between 1 and 5")
+	}
+	if c.Stream.Storage != StorageFile && c.Stream.Storage != StorageMemory {
+		errs.add("stream: storage must be %s or %s", StorageFile, StorageMemory)
+	}
+	if c.Stream.Discard != DiscardOld && c.Stream.Discard != DiscardNew {
+		errs.add("stream: discard must be %s or %s", DiscardOld, DiscardNew)
+	}
+	if c.Stream.DuplicateWindow < 0 || (c.Stream.MaxAge != nil && *c.Stream.MaxAge > 0 && c.Stream.DuplicateWindow > *c.Stream.MaxAge) {
+		errs.add("stream: duplicate_window must be between 0 and max_age")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddontang/go/log"
+)
+
+// ConsumerLookup returns the consumer of the distributor with the given name
+type ConsumerLookup func(name string) (*Consumer, bool)
+
+type Admin struct {
+	consumers ConsumerLookup
+	// token has to be sent as bearer token
+	token string
+}
+
+func NewAdmin(consumers ConsumerLookup, token string) *Admin {
+	return &Admin{consumers: consumers, token: token}
+}
+
+// RegisterRoutes adds the admin api to the router. Without a token the admin api is disabled,
+// it shares the listener of the metrics and would let anybody resend events to all recipients.
+func (a *Admin) RegisterRoutes(r *mux.Router) {
+	if a.token == "" {
+		log.Warn("no admin token configured. admin api disabled")
+		return
+	}
+	r.HandleFunc("/admin/distributors/{name}/replay", a.authorized(a.replayHandler)).Methods("POST")
+}
+
+// authorized rejects requests without the admin token
+func (a *Admin) authorized(next http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + a.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			log.Warnf("rejecting admin request without valid token from %s", r.RemoteAddr)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type replayProgress struct {
+	Event   *ReplayEvent   `json:"event,omitempty"`
+	Summary *ReplaySummary `json:"summary,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// replayHandler replays events to a distributor and streams the progress as json lines.
+// query parameters: object (required), region, start_sequence, start_time (RFC3339), dry_run
+func (a *Admin) replayHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	c, ok := a.consumers(name)
+	if !ok {
+		http.Error(w, "unknown distributor "+name, http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	opts := ReplayOptions{
+		Region: q.Get("region"),
+		Object: q.Get("object"),
+	}
+	if opts.Object == "" {
+		http.Error(w, "query parameter object is required", http.StatusBadRequest)
+		return
+	}
+	// the region is a single subject token, wildcards would replay the events of other regions
+	if invalidTokenRx.MatchString(opts.Region) {
+		http.Error(w, "invalid region "+strconv.Quote(opts.Region), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if v := q.Get("start_sequence"); v != "" {
+		if opts.StartSequence, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid start_sequence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("start_time"); v != "" {
+		if opts.StartTime, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid start_time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("dry_run"); v != "" {
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid dry_run: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	write := func(p replayProgress) {
+		if err := enc.Encode(p); err != nil {
+			log.Errorf("replay write progress error: %s", err.Error())
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	sum, err := c.Replay(r.Context(), opts, func(e ReplayEvent) {
+		write(replayProgress{Event: &e})
+	})
+	if err != nil {
+		log.Errorf("replay to %s failed: %s", name, err.Error())
+		write(replayProgress{Error: err.Error()})
+	}
+	write(replayProgress{Summary: &sum})
+}
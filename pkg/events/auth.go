@@ -0,0 +1,154 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// headers describing the delivery, sent with every event
+const (
+	DistributorHdr      = "Netbox-Distributor"
+	EventIDHdr          = "Netbox-Event-Id"
+	DeliveryAttemptHdr  = "Netbox-Delivery-Attempt"
+	StreamSequenceHdr   = "Netbox-Stream-Sequence"
+	signatureTimeHeader = "X-Hook-Timestamp"
+)
+
+// outboundAuth authenticates the distributor to the recipient
+type outboundAuth struct {
+	hmacHeader    string
+	hmacHash      func() hash.Hash
+	hmacSecret    []byte
+	hmacTimestamp bool
+	authorization string
+	headers       map[string]string
+	// tokens are fetched from an oauth2 or keystone token endpoint and sent in tokenHeader
+	tokens      *tokenProvider
+	tokenHeader string
+	tokenPrefix string
+}
+
+// newOutboundAuth reads the secrets of the auth config, a nil config adds no authentication.
+// Tokens are fetched with the connections of client.
+func newOutboundAuth(a *config.Auth, client *http.Client) (o *outboundAuth, err error) {
+	o = &outboundAuth{headers: make(map[string]string)}
+	if a == nil {
+		return
+	}
+	if a.HMAC != nil {
+		secret, err := a.HMAC.Secret.Value()
+		if err != nil {
+			return nil, err
+		}
+		o.hmacSecret = []byte(secret)
+		o.hmacHeader = a.HMAC.Header
+		if o.hmacHeader == "" {
+			o.hmacHeader = signatureHeader
+		}
+		o.hmacHash = sha512.New
+		if a.HMAC.Algorithm == config.HMACSHA256 {
+			o.hmacHash = sha256.New
+		}
+		o.hmacTimestamp = a.HMAC.Timestamp
+	}
+	if a.Bearer != nil {
+		token, err := a.Bearer.Value()
+		if err != nil {
+			return nil, err
+		}
+		o.authorization = "Bearer " + token
+	}
+	if a.Basic != nil {
+		password, err := a.Basic.Password.Value()
+		if err != nil {
+			return nil, err
+		}
+		o.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Basic.Username+":"+password))
+	}
+	if a.OAuth2 != nil {
+		source, err := oauth2ClientCredentials(a.OAuth2)
+		if err != nil {
+			return nil, err
+		}
+		o.tokens, o.tokenHeader, o.tokenPrefix = newTokenProvider(source, client), "Authorization", "Bearer "
+	}
+	if a.Keystone != nil {
+		source, err := keystoneTokenSource(a.Keystone)
+		if err != nil {
+			return nil, err
+		}
+		o.tokens, o.tokenHeader = newTokenProvider(source, client), "X-Auth-Token"
+	}
+	for h, ref := range a.Headers {
+		if o.headers[h], err = ref.Value(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// apply adds the authentication headers to the message, the signature is computed over the rendered data.
+// It returns the token sent, if any.
+func (o *outboundAuth) apply(ctx context.Context, m *Message, now time.Time) (token string, err error) {
+	for h, v := range o.headers {
+		m.Headers[h] = v
+	}
+	if o.authorization != "" {
+		m.Headers["Authorization"] = o.authorization
+	}
+	if o.tokens != nil {
+		if token, err = o.tokens.token(ctx); err != nil {
+			return
+		}
+		m.Headers[o.tokenHeader] = o.tokenPrefix + token
+	}
+	if o.hmacSecret != nil {
+		mac := hmac.New(o.hmacHash, o.hmacSecret)
+		if o.hmacTimestamp {
+			ts := strconv.FormatInt(now.Unix(), 10)
+			m.Headers[signatureTimeHeader] = ts
+			mac.Write([]byte(ts + "."))
+		}
+		mac.Write(m.Data)
+		m.Headers[o.hmacHeader] = hex.EncodeToString(mac.Sum(nil))
+	}
+	return
+}
+
+// rejected is true if the recipient rejected the token, which is then dropped from the cache
+func (o *outboundAuth) rejected(token string, err error) bool {
+	if o.tokens == nil || token == "" {
+		return false
+	}
+	if dErr, ok := err.(*DispatchError); !ok || dErr.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	o.tokens.invalidate(token)
+	return true
+}
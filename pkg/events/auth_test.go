@@ -0,0 +1,103 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+func TestOutboundAuth(t *testing.T) {
+	t.Setenv("TEST_HMAC_SECRET", "s3cret")
+	t.Setenv("TEST_BEARER", "tok")
+	t.Setenv("TEST_API_KEY", "key")
+	secret := config.SecretRef{Env: "TEST_HMAC_SECRET"}
+	data := []byte(`{"event":"created","model":"device","data":{"id":1}}`)
+	now := time.Unix(1638352800, 0)
+
+	sha256Hex := func(msg string) string {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(msg))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		name string
+		auth *config.Auth
+		want map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{"hmac sha512, verifiable like a Netbox signature", &config.Auth{HMAC: &config.HMACAuth{Secret: secret}},
+			map[string]string{signatureHeader: sign(data, "s3cret")}},
+		{"hmac sha256 in another header", &config.Auth{HMAC: &config.HMACAuth{Algorithm: config.HMACSHA256, Header: "X-Signature", Secret: secret}},
+			map[string]string{"X-Signature": sha256Hex(string(data))}},
+		{"hmac with timestamp", &config.Auth{HMAC: &config.HMACAuth{Algorithm: config.HMACSHA256, Secret: secret, Timestamp: true}},
+			map[string]string{signatureTimeHeader: "1638352800", signatureHeader: sha256Hex("1638352800." + string(data))}},
+		{"bearer", &config.Auth{Bearer: &config.SecretRef{Env: "TEST_BEARER"}},
+			map[string]string{"Authorization": "Bearer tok"}},
+		{"basic", &config.Auth{Basic: &config.BasicAuth{Username: "user", Password: config.SecretRef{Env: "TEST_BEARER"}}},
+			map[string]string{"Authorization": "Basic dXNlcjp0b2s="}},
+		{"headers and hmac", &config.Auth{HMAC: &config.HMACAuth{Secret: secret}, Headers: map[string]config.SecretRef{"X-Api-Key": {Env: "TEST_API_KEY"}}},
+			map[string]string{"X-Api-Key": "key", signatureHeader: sign(data, "s3cret")}},
+	}
+	for _, tt := range tests {
+		o, err := newOutboundAuth(tt.auth, nil)
+		if err != nil {
+			t.Fatalf("%s: newOutboundAuth error: %s", tt.name, err.Error())
+		}
+		m := Message{Data: data, Headers: map[string]string{DistributorHdr: "test"}}
+		if _, err := o.apply(context.Background(), &m, now); err != nil {
+			t.Fatalf("%s: apply error: %s", tt.name, err.Error())
+		}
+		if len(m.Headers) != len(tt.want)+1 {
+			t.Errorf("%s: headers %v, want %v", tt.name, m.Headers, tt.want)
+		}
+		for h, want := range tt.want {
+			if got := m.Headers[h]; got != want {
+				t.Errorf("%s: header %s = %q, want %q", tt.name, h, got, want)
+			}
+		}
+	}
+}
+
+// TestOutboundSignatureVerified checks that the signature of the distributor is accepted by the webhook verification
+func TestOutboundSignatureVerified(t *testing.T) {
+	t.Setenv("TEST_HMAC_SECRET", "s3cret")
+	o, err := newOutboundAuth(&config.Auth{HMAC: &config.HMACAuth{Secret: config.SecretRef{Env: "TEST_HMAC_SECRET"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Message{Data: []byte(`{"id":1}`), Headers: map[string]string{}}
+	if _, err := o.apply(context.Background(), &m, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !verifySignature(m.Data, m.Headers[signatureHeader], [][]byte{[]byte("other"), []byte("s3cret")}) {
+		t.Error("signature of the distributor not verified")
+	}
+}
+
+func TestOutboundAuthMissingSecret(t *testing.T) {
+	_, err := newOutboundAuth(&config.Auth{Bearer: &config.SecretRef{Env: "TEST_UNSET_SECRET"}}, nil)
+	if err == nil {
+		t.Error("newOutboundAuth with an unset secret succeeded")
+	}
+}
@@ -17,46 +17,79 @@
 package events
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/filter"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/transform"
 	"github.com/siddontang/go/log"
-	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/util/retry"
 )
 
-var waitBackoff = wait.Backoff{
-	Steps:    50,
-	Duration: 50 * time.Millisecond,
-	Factor:   1.1,
-	Jitter:   0.1,
-}
+// pendingInterval is the interval the number of pending events of the durable consumers is updated in
+const pendingInterval = 15 * time.Second
 
 type DispatchError struct {
 	StatusCode int
+	// RetryAfter is the delay requested by the recipient with a Retry-After header
+	RetryAfter time.Duration
 	Err        error
 }
 
 func (d *DispatchError) Error() string {
+	if d.Err == nil {
+		return fmt.Sprintf("unexpected http status code %d", d.StatusCode)
+	}
 	return d.Err.Error()
 }
 
 type Consumer struct {
-	js     nats.JetStreamContext
-	name   string
-	config config.Distributor
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	name      string
+	config    config.Distributor
+	filter    *filter.Filter
+	transform *transform.Template
+	sink      Sink
+	retry     *retryPolicy
+	auth      *outboundAuth
+	// concurrency of the deliveries of every subscription
+	concurrency config.Concurrency
+	// client is shared by the http requests of the distributor
+	client *http.Client
+	// dispatchTimeout limits a single attempt to send an event
+	dispatchTimeout time.Duration
+
+	cancel context.CancelFunc
+	// abort is cancelled to give up the deliveries in progress on shutdown
+	abort       context.Context
+	cancelAbort context.CancelFunc
+	wg          sync.WaitGroup
+	subs        map[string]*subscriptionState
 
-	distributionSuccess prometheus.Counter
-	distributionErrors  prometheus.Counter
+	distributionSuccess      prometheus.Counter
+	distributionErrors       prometheus.Counter
+	distributionDeadLetters  prometheus.Counter
+	distributionFiltered     prometheus.Counter
+	distributionRedeliveries prometheus.Counter
+	dispatchDuration         prometheus.Histogram
+	dispatchResponses        *prometheus.CounterVec
+	deliveryAttempts         prometheus.Histogram
+	deliveryLag              prometheus.Histogram
+	pending                  *prometheus.GaugeVec
+	workers                  prometheus.Gauge
+	busyWorkers              prometheus.Gauge
 }
 
 func NewConsumer(d config.Distributor, nc *nats.Conn, ctx context.Context) (c *Consumer, err error) {
@@ -65,10 +98,15 @@ func NewConsumer(d config.Distributor, nc *nats.Conn, ctx context.Context) (c *C
 	if err != nil {
 		return
 	}
+	httpConfig := d.HTTPClientConfig()
 	c = &Consumer{
-		name:   d.Name,
-		config: d,
-		js:     js,
+		name:            d.Name,
+		config:          d,
+		nc:              nc,
+		js:              js,
+		retry:           newRetryPolicy(d.RetryPolicy()),
+		concurrency:     d.ConcurrencyConfig(),
+		dispatchTimeout: httpConfig.Timeout,
 		distributionSuccess: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem:   "distribution",
 			Name:        "success_total",
@@ -78,101 +116,499 @@ func NewConsumer(d config.Distributor, nc *nats.Conn, ctx context.Context) (c *C
 		distributionErrors: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem:   "distribution",
 			Name:        "errors_total",
-			Help:        "Total number of successfully distributed webhooks",
+			Help:        "Total number of webhooks which could not be distributed after all retries",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		distributionDeadLetters: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem:   "distribution",
+			Name:        "dead_letters_total",
+			Help:        "Total number of webhooks moved to the dead-letter stream after all retries failed",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		distributionFiltered: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem:   "distribution",
+			Name:        "filtered_total",
+			Help:        "Total number of webhooks not distributed because of the filter",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		distributionRedeliveries: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem:   "distribution",
+			Name:        "redeliveries_total",
+			Help:        "Total number of failed webhooks nak'ed to be redelivered by JetStream",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		dispatchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem:   "distribution",
+			Name:        "dispatch_duration_seconds",
+			Help:        "Duration of a single attempt to send a webhook to the recipient",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		dispatchResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem:   "distribution",
+			Name:        "responses_total",
+			Help:        "Total number of attempts to send a webhook by http status code, ok, timeout or error",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}, []string{"code"}),
+		deliveryAttempts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem:   "distribution",
+			Name:        "attempts",
+			Help:        "Number of attempts needed to deliver a webhook",
+			Buckets:     []float64{1, 2, 3, 5, 10, 20, 50},
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		deliveryLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem:   "distribution",
+			Name:        "lag_seconds",
+			Help:        "Time from storing a webhook in the stream until it was delivered",
+			Buckets:     prometheus.ExponentialBuckets(0.01, 4, 10),
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		pending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem:   "distribution",
+			Name:        "pending",
+			Help:        "Number of events the durable consumer has not received yet",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}, []string{"object"}),
+		workers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem:   "distribution",
+			Name:        "workers",
+			Help:        "Number of workers delivering the events of each object type",
+			ConstLabels: prometheus.Labels{"consumer": d.Name},
+		}),
+		busyWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem:   "distribution",
+			Name:        "busy_workers",
+			Help:        "Number of workers currently delivering events",
 			ConstLabels: prometheus.Labels{"consumer": d.Name},
 		}),
 	}
-	if err = prometheus.Register(c.distributionSuccess); err != nil {
-		return
+	c.workers.Set(float64(c.concurrency.Workers))
+	if d.Filter != "" {
+		if c.filter, err = filter.Parse(d.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if d.Transform != nil && d.Transform.Template != "" {
+		if c.transform, err = transform.Parse(d.Name, d.Transform.Template); err != nil {
+			return nil, err
+		}
+	}
+	if err = createDeadLetterStream(js); err != nil {
+		return nil, err
+	}
+	if c.client, err = newHTTPClient(d.Name, httpConfig); err != nil {
+		return nil, err
+	}
+	if c.auth, err = newOutboundAuth(d.Auth, c.client); err != nil {
+		return nil, err
 	}
-	return c, prometheus.Register(c.distributionErrors)
+	if c.sink, err = newSink(d, nc, c.client); err != nil {
+		return nil, err
+	}
+	if err = c.register(); err != nil {
+		c.sink.Close()
+		return nil, err
+	}
+	return
+}
+
+func (c *Consumer) collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.distributionSuccess, c.distributionErrors, c.distributionDeadLetters, c.distributionFiltered, c.distributionRedeliveries,
+		c.dispatchDuration, c.dispatchResponses, c.deliveryAttempts, c.deliveryLag, c.pending, c.workers, c.busyWorkers}
+}
+
+// register registers the metrics of the consumer. Nothing is registered on error.
+func (c *Consumer) register() (err error) {
+	var registered []prometheus.Collector
+	for _, col := range c.collectors() {
+		if err = prometheus.Register(col); err != nil {
+			for _, r := range registered {
+				prometheus.Unregister(r)
+			}
+			return
+		}
+		registered = append(registered, col)
+	}
+	return
 }
 
 func (c *Consumer) Subscribe(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.abort, c.cancelAbort = context.WithCancel(context.Background())
+	c.subs = make(map[string]*subscriptionState, len(c.config.NetboxWebhooks))
 	for object := range c.config.NetboxWebhooks {
-		go c.subscribe(fmt.Sprintf("NETBOX.%s.%s", c.config.Region, object), fmt.Sprintf("%s-%s-%s", c.name, c.config.Region, object), object, ctx)
+		state := &subscriptionState{}
+		state.setAlive(true)
+		state.fetched()
+		c.subs[object] = state
+		c.wg.Add(1)
+		go func(object string) {
+			defer c.wg.Done()
+			defer state.setAlive(false)
+			c.subscribe(fmt.Sprintf("NETBOX.%s.%s", c.config.Region, object), c.durableName(object), object, ctx, state)
+		}(object)
+		if c.retry.redelivery() {
+			c.wg.Add(1)
+			go func(object string) {
+				defer c.wg.Done()
+				c.deadLetterMaxDeliveries(ctx, c.nc, c.durableName(object), object)
+			}(object)
+		}
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.updatePending(ctx)
+	}()
+}
+
+func (c *Consumer) durableName(object string) string {
+	return fmt.Sprintf("%s-%s-%s", c.name, c.config.Region, object)
+}
+
+// updatePending periodically sets the number of pending events of the durable consumers
+func (c *Consumer) updatePending(ctx context.Context) {
+	ticker := time.NewTicker(pendingInterval)
+	defer ticker.Stop()
+	for {
+		for object := range c.config.NetboxWebhooks {
+			info, err := c.js.ConsumerInfo(streamName, c.durableName(object))
+			if err != nil {
+				log.Debugf("consumer info of %s error: %s", c.durableName(object), err.Error())
+				continue
+			}
+			c.pending.WithLabelValues(object).Set(float64(info.NumPending))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops fetching new events, waits for the event in progress and unregisters the metrics.
+// The durable consumers are kept, a new Consumer with the same config continues where this one stopped.
+func (c *Consumer) Stop() {
+	c.Shutdown(context.Background())
+}
+
+// Shutdown stops like Stop, but gives up the events in progress once ctx is done.
+// They are nak'ed and redelivered after the restart.
+func (c *Consumer) Shutdown(ctx context.Context) {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("consumer %s did not finish its deliveries in time. aborting", c.name)
+		c.cancelAbort()
+		<-done
+	}
+	if c.cancelAbort != nil {
+		c.cancelAbort()
+	}
+	for _, col := range c.collectors() {
+		prometheus.Unregister(col)
+	}
+	if err := c.sink.Close(); err != nil {
+		log.Errorf("close sink of %s error: %s", c.name, err.Error())
+	}
+	c.client.CloseIdleConnections()
+	log.Debugf("stopped consumer %s", c.name)
+}
+
+// durableConsumer creates the durable consumer if it does not exist, or updates its max deliveries
+// if the retry mode changed. Subscriptions bound to an existing consumer do not delete it when unsubscribing.
+func (c *Consumer) durableConsumer(subj, name string) (err error) {
+	wanted := &nats.ConsumerConfig{
+		Durable:       name,
+		FilterSubject: subj,
+		AckPolicy:     nats.AckExplicitPolicy,
+		MaxWaiting:    128,
+		MaxDeliver:    -1,
+	}
+	if c.retry.redelivery() {
+		wanted.MaxDeliver = c.retry.Steps
+		wanted.AckWait = redeliveryAckWait
+	}
+	info, err := c.js.ConsumerInfo(streamName, name)
+	if err == nil {
+		if info.Config.MaxDeliver == wanted.MaxDeliver {
+			return
+		}
+		log.Infof("updating max deliveries of consumer %s from %d to %d", name, info.Config.MaxDeliver, wanted.MaxDeliver)
+		if !c.retry.redelivery() {
+			wanted.AckWait = info.Config.AckWait
+		}
+		_, err = c.js.AddConsumer(streamName, wanted)
+		return
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return
+	}
+	_, err = c.js.AddConsumer(streamName, wanted)
+	return
+}
+
+// Live returns an error if a subscription goroutine stopped
+func (c *Consumer) Live() error {
+	for _, object := range sortedObjects(c.subs) {
+		if atomic.LoadInt32(&c.subs[object].alive) == 0 {
+			return fmt.Errorf("subscription %s is not running", object)
+		}
 	}
+	return nil
 }
 
-func (c *Consumer) subscribe(subj, name, object string, ctx context.Context) {
+// Ready returns an error if a subscription did not fetch events recently
+func (c *Consumer) Ready() error {
+	for _, object := range sortedObjects(c.subs) {
+		if c.subs[object].stale() {
+			return fmt.Errorf("subscription %s did not fetch events for more than %s", object, fetchStaleAfter)
+		}
+	}
+	return nil
+}
+
+func (c *Consumer) subscribe(subj, name, object string, ctx context.Context, state *subscriptionState) {
+	if err := c.durableConsumer(subj, name); err != nil {
+		log.Errorf("could not create consumer %s: %s", name, err.Error())
+		return
+	}
 	sub, err := c.js.PullSubscribe(subj, name, nats.PullMaxWaiting(128))
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("could not subscribe to %s: %s", subj, err.Error())
+		return
 	}
+	defer sub.Unsubscribe()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
-		msgs, err := sub.Fetch(1, nats.Context(ctx))
+		msgs, err := sub.Fetch(c.concurrency.Batch, nats.Context(ctx))
+		state.fetched()
 		if err != nil {
-			if errors.Is(err, nats.ErrTimeout) {
-				return
-			}
+			// no new events or ctx is done
 			continue
 		}
-	MESSAGES:
-		for _, msg := range msgs {
-			if err = msg.InProgress(nats.AckWait(6 * time.Second)); err != nil {
-				log.Errorf("set msg inProgress error %s", err.Error())
-				continue
-			}
-			wb := WebhookBody{}
-			if err = json.Unmarshal(msg.Data, &wb); err != nil {
-				log.Errorf("msg data unmarshal error %s", err.Error())
-				c.ack(msg)
-				continue
-			}
-			for _, e := range c.config.NetboxWebhooks[object] {
-				//update, create, delete
-				if e != wb.Event {
-					continue
-				}
-				log.Debugf("dispatching: %s, %s", msg.Subject, c.config.URL)
-				resultErr := retry.OnError(waitBackoff, func(err error) bool {
-					return isRetryError(err)
-				}, func() error {
-					meta, _ := msg.Metadata()
-					if meta != nil {
-						log.Debugf("retry dispatching: %s, time: %s to %s", msg.Subject, meta.Timestamp, c.config.URL)
-					}
-					return c.dispatch(msg.Data)
-				})
-				if resultErr != nil {
-					c.distributionErrors.Inc()
-					log.Debugf("error dispatching event: %s ==> %s: error %s", msg.Subject, c.config.URL, resultErr.Error())
-					log.Errorf("done retrying to deliver event to %s. dropping event", c.name)
-					c.ack(msg)
-					continue MESSAGES
-				}
+		c.processBatch(msgs, object, state)
+	}
+}
+
+// process delivers a single event and acks, naks or dead-letters it
+func (c *Consumer) process(msg *nats.Msg, object string, state *subscriptionState) {
+	if c.abort.Err() != nil {
+		c.nak(msg)
+		return
+	}
+	if err := msg.InProgress(nats.AckWait(6 * time.Second)); err != nil {
+		log.Errorf("set msg inProgress error %s", err.Error())
+		return
+	}
+	wb := WebhookBody{}
+	if err := json.Unmarshal(msg.Data, &wb); err != nil {
+		log.Errorf("msg data unmarshal error %s", err.Error())
+		c.ack(msg)
+		return
+	}
+	if c.wants(object, wb.Event) {
+		if !c.matches(msg) {
+			log.Debugf("event %s filtered for %s", msg.Subject, c.name)
+			c.distributionFiltered.Inc()
+			c.ack(msg)
+			return
+		}
+		state.startDelivering()
+		var d delivery
+		if c.retry.redelivery() {
+			d = c.deliverOnce(c.abort, msg)
+		} else {
+			d = c.deliver(c.abort, msg)
+		}
+		state.doneDelivering()
+		if d.err != nil && c.abort.Err() != nil {
+			log.Infof("delivery of %s to %s aborted. redelivering after restart", msg.Subject, c.name)
+			c.nak(msg)
+			return
+		}
+		if d.err != nil && c.retry.redelivery() && c.redeliver(msg, d) {
+			return
+		}
+		c.deliveryAttempts.Observe(float64(d.attempts))
+		if d.err != nil {
+			c.distributionErrors.Inc()
+			log.Debugf("error dispatching event: %s ==> %s: error %s", msg.Subject, c.sink, d.err.Error())
+			if err := c.deadLetter(msg, object, d); err != nil {
+				log.Errorf("could not move event to dead-letter stream: %s. retrying later", err.Error())
+				c.nak(msg)
+				return
 			}
+			log.Errorf("done retrying to deliver event to %s. moved event to dead-letter stream", c.name)
+			c.distributionDeadLetters.Inc()
 			c.ack(msg)
-			c.distributionSuccess.Inc()
+			return
+		}
+		c.ack(msg)
+		c.distributionSuccess.Inc()
+		if meta, err := msg.Metadata(); err == nil {
+			c.deliveryLag.Observe(time.Since(meta.Timestamp).Seconds())
 		}
+		return
 	}
+	// events of the object the distributor did not subscribe to
+	c.ack(msg)
 }
 
-func (c *Consumer) dispatch(data []byte) (err error) {
-	req, err := http.NewRequest("POST", c.config.URL, bytes.NewBuffer(data))
+func sortedObjects(subs map[string]*subscriptionState) []string {
+	objects := make([]string, 0, len(subs))
+	for o := range subs {
+		objects = append(objects, o)
+	}
+	sort.Strings(objects)
+	return objects
+}
+
+// wants reports whether the distributor subscribed to the event (created, updated, deleted) of object
+func (c *Consumer) wants(object, event string) bool {
+	for _, e := range c.config.NetboxWebhooks[object] {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// matches evaluates the filter of the distributor against the event
+func (c *Consumer) matches(msg *nats.Msg) bool {
+	if c.filter == nil {
+		return true
+	}
+	ok, err := c.filter.MatchJSON(msg.Data)
 	if err != nil {
-		return
+		log.Errorf("filter event %s error: %s", msg.Subject, err.Error())
+		return false
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	return ok
+}
+
+// deliver dispatches the event to the recipient and retries on temporary errors until ctx is done
+func (c *Consumer) deliver(ctx context.Context, msg *nats.Msg) (d delivery) {
+	log.Debugf("dispatching: %s, %s", msg.Subject, c.sink)
+	m, err := c.message(msg)
 	if err != nil {
+		d.attempt()
+		d.err = err
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return &DispatchError{
-			StatusCode: resp.StatusCode,
+	d.err = c.retry.do(ctx, func() error {
+		d.attempt()
+		if d.attempts > 1 {
+			// reset the ack wait, so the event is not redelivered while retrying.
+			// replayed events are not acked, which is fine to ignore.
+			msg.InProgress()
+		}
+		meta, _ := msg.Metadata()
+		if meta != nil {
+			log.Debugf("retry dispatching: %s, time: %s to %s", msg.Subject, meta.Timestamp, c.sink)
 		}
+		return c.dispatch(ctx, m, d.attempts)
+	})
+	return
+}
+
+// Render applies the transform of the distributor to the event
+func (c *Consumer) Render(data []byte) ([]byte, error) {
+	if c.transform == nil {
+		return data, nil
 	}
+	return c.transform.Execute(data)
+}
+
+// message renders the event for the sink
+func (c *Consumer) message(msg *nats.Msg) (m Message, err error) {
+	wb := WebhookBody{}
+	if err = json.Unmarshal(msg.Data, &wb); err != nil {
+		return
+	}
+	m = Message{
+		Subject:     msg.Subject,
+		Key:         fmt.Sprintf("%s.%d", wb.Model, wb.Data.ID),
+		ContentType: c.config.ContentType(),
+		Headers:     map[string]string{DistributorHdr: c.name},
+	}
+	for k, v := range c.config.Headers() {
+		m.Headers[k] = v
+	}
+	if meta, _ := msg.Metadata(); meta != nil {
+		m.Headers[StreamSequenceHdr] = strconv.FormatUint(meta.Sequence.Stream, 10)
+		m.Headers[EventIDHdr] = m.Headers[StreamSequenceHdr]
+	}
+	// the id derived by the webhook to deduplicate events
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		m.Headers[EventIDHdr] = id
+	}
+	m.Data, err = c.Render(msg.Data)
 	return
 }
 
+// dispatch sends one attempt of the message, signed with the auth of the distributor
+func (c *Consumer) dispatch(ctx context.Context, m Message, attempt int) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.dispatchTimeout)
+	defer cancel()
+	headers := make(map[string]string, len(m.Headers)+4)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	m.Headers = headers
+	m.Headers[DeliveryAttemptHdr] = strconv.Itoa(attempt)
+	token, err := c.send(ctx, m)
+	if c.auth.rejected(token, err) {
+		// the token may have been revoked before it expired, fetch a new one and try once more
+		log.Infof("token rejected by %s. fetching a new one", c.sink)
+		_, err = c.send(ctx, m)
+	}
+	return
+}
+
+// send authenticates and sends the message, it returns the token sent
+func (c *Consumer) send(ctx context.Context, m Message) (token string, err error) {
+	if token, err = c.auth.apply(ctx, &m, time.Now()); err != nil {
+		return
+	}
+	start := time.Now()
+	err = c.sink.Send(ctx, m)
+	c.dispatchDuration.Observe(time.Since(start).Seconds())
+	c.dispatchResponses.WithLabelValues(responseCode(err)).Inc()
+	return
+}
+
+// responseCode is the http status code of a dispatch error, or ok, timeout or error
+func responseCode(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if err, ok := err.(*DispatchError); ok && err.StatusCode != 0 {
+		return strconv.Itoa(err.StatusCode)
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "error"
+}
+
 func (c *Consumer) ack(msg *nats.Msg) (err error) {
 	if err = msg.AckSync(); err != nil {
 		log.Errorf("ackSync error: %s", err)
@@ -180,16 +616,9 @@ func (c *Consumer) ack(msg *nats.Msg) (err error) {
 	return
 }
 
-// only retry on timeout or server (500 / 503) errors
-func isRetryError(err error) bool {
-	if err, ok := err.(net.Error); ok && err.Timeout() {
-		return true
+func (c *Consumer) nak(msg *nats.Msg) (err error) {
+	if err = msg.Nak(); err != nil {
+		log.Errorf("nak error: %s", err)
 	}
-	if err, ok := err.(*DispatchError); ok {
-		if err.StatusCode == http.StatusInternalServerError ||
-			err.StatusCode == http.StatusServiceUnavailable {
-			return true
-		}
-	}
-	return false
+	return
 }
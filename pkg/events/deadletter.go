@@ -0,0 +1,148 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siddontang/go/log"
+)
+
+const (
+	deadLetterStreamName     = "NETBOX_DLQ"
+	deadLetterStreamSubjects = "NETBOX_DLQ.>"
+	deadLetterMaxAge         = 14 * 24 * time.Hour
+	// deadLetterErrorMaxLen caps the error header, errors may contain complete response bodies
+	deadLetterErrorMaxLen = 1024
+)
+
+// headers attached to every dead-lettered event
+const (
+	DeadLetterDistributorHdr    = "Netbox-Dlq-Distributor"
+	DeadLetterSubjectHdr        = "Netbox-Dlq-Original-Subject"
+	DeadLetterSequenceHdr       = "Netbox-Dlq-Stream-Sequence"
+	DeadLetterPublishedHdr      = "Netbox-Dlq-Published"
+	DeadLetterStatusHdr         = "Netbox-Dlq-Status"
+	DeadLetterErrorHdr          = "Netbox-Dlq-Error"
+	DeadLetterAttemptsHdr       = "Netbox-Dlq-Attempts"
+	DeadLetterFirstAttemptHdr   = "Netbox-Dlq-First-Attempt"
+	DeadLetterLastAttemptHdr    = "Netbox-Dlq-Last-Attempt"
+	DeadLetterDeadLetteredAtHdr = "Netbox-Dlq-Dead-Lettered-At"
+)
+
+// delivery records the outcome of all attempts to deliver one event
+type delivery struct {
+	attempts     int
+	firstAttempt time.Time
+	lastAttempt  time.Time
+	err          error
+}
+
+func (d *delivery) attempt() {
+	d.attempts++
+	d.lastAttempt = time.Now()
+	if d.firstAttempt.IsZero() {
+		d.firstAttempt = d.lastAttempt
+	}
+}
+
+// statusCode returns the last http status code received, or 0 if there was none
+func (d *delivery) statusCode() int {
+	var dErr *DispatchError
+	if errors.As(d.err, &dErr) {
+		return dErr.StatusCode
+	}
+	return 0
+}
+
+func createDeadLetterStream(js nats.JetStreamContext) (err error) {
+	stream, _ := js.StreamInfo(deadLetterStreamName)
+	if stream != nil {
+		return
+	}
+	log.Debugf("creating stream %q and subjects %q", deadLetterStreamName, deadLetterStreamSubjects)
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     deadLetterStreamName,
+		Subjects: []string{deadLetterStreamSubjects},
+		MaxAge:   deadLetterMaxAge,
+	})
+	return
+}
+
+func deadLetterSubject(distributor, region, object string) string {
+	return fmt.Sprintf("%s.%s.%s.%s", deadLetterStreamName, distributor, region, object)
+}
+
+// deadLetter republishes an event, which could not be delivered, to the dead-letter stream
+func (c *Consumer) deadLetter(msg *nats.Msg, object string, d delivery) (err error) {
+	var seq uint64
+	var published time.Time
+	if meta, _ := msg.Metadata(); meta != nil {
+		seq, published = meta.Sequence.Stream, meta.Timestamp
+	}
+	return c.publishDeadLetter(msg.Subject, msg.Data, seq, published, object, d)
+}
+
+func (c *Consumer) publishDeadLetter(subject string, data []byte, seq uint64, published time.Time, object string, d delivery) (err error) {
+	dlq := nats.NewMsg(deadLetterSubject(c.name, c.config.Region, object))
+	dlq.Data = data
+	dlq.Header.Set(DeadLetterDistributorHdr, c.name)
+	dlq.Header.Set(DeadLetterSubjectHdr, subject)
+	if seq != 0 {
+		dlq.Header.Set(DeadLetterSequenceHdr, strconv.FormatUint(seq, 10))
+		dlq.Header.Set(DeadLetterPublishedHdr, published.UTC().Format(time.RFC3339Nano))
+	}
+	dlq.Header.Set(DeadLetterStatusHdr, strconv.Itoa(d.statusCode()))
+	if d.err != nil {
+		dlq.Header.Set(DeadLetterErrorHdr, headerValue(d.err.Error(), deadLetterErrorMaxLen))
+	}
+	dlq.Header.Set(DeadLetterAttemptsHdr, strconv.Itoa(d.attempts))
+	// unknown if the first attempts happened in earlier deliveries
+	if !d.firstAttempt.IsZero() {
+		dlq.Header.Set(DeadLetterFirstAttemptHdr, d.firstAttempt.UTC().Format(time.RFC3339Nano))
+	}
+	dlq.Header.Set(DeadLetterLastAttemptHdr, d.lastAttempt.UTC().Format(time.RFC3339Nano))
+	dlq.Header.Set(DeadLetterDeadLetteredAtHdr, time.Now().UTC().Format(time.RFC3339Nano))
+	_, err = c.js.PublishMsg(dlq)
+	return
+}
+
+// headerValue replaces line breaks and other control characters, which break the header encoding,
+// with spaces and truncates v to at most max bytes
+func headerValue(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, v)
+	if len(v) <= max {
+		return v
+	}
+	v = v[:max]
+	for len(v) > 0 && !utf8.ValidString(v) {
+		v = v[:len(v)-1]
+	}
+	return v
+}
@@ -0,0 +1,46 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"status 502", 20, "status 502"},
+		{"status 502: <html>\r\n<body>bad gateway</body>\n</html>", 100, "status 502: <html>  <body>bad gateway</body> </html>"},
+		{"x509: certificate\tsigned by unknown authority", 100, "x509: certificate signed by unknown authority"},
+		{"0123456789", 4, "0123"},
+		// multi-byte runes are not split
+		{"äöü", 3, "ä"},
+		{"äöü", 4, "äö"},
+	}
+	for _, tt := range tests {
+		if got := headerValue(tt.in, tt.max); got != tt.want {
+			t.Errorf("headerValue(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+	if got := headerValue(strings.Repeat("a", 2000), deadLetterErrorMaxLen); len(got) != deadLetterErrorMaxLen {
+		t.Errorf("header value of %d bytes, want %d", len(got), deadLetterErrorMaxLen)
+	}
+}
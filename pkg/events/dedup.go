@@ -0,0 +1,54 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/filter"
+)
+
+// eventID derives the JetStream message id of a webhook from the configured fields.
+// An empty id disables deduplication for the event.
+func eventID(cfg config.DeduplicationConfig, body []byte) (id string, err error) {
+	if cfg.Disabled {
+		return
+	}
+	var event interface{}
+	if err = json.Unmarshal(body, &event); err != nil {
+		return
+	}
+	h := sha256.New()
+	for _, f := range cfg.Fields {
+		if f == config.DeduplicationBody {
+			h.Write(body)
+		} else {
+			v, err := json.Marshal(filter.Lookup(event, f))
+			if err != nil {
+				return "", fmt.Errorf("deduplication field %s: %s", f, err.Error())
+			}
+			h.Write(v)
+		}
+		// separate the fields, so values can not shift into the next field
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
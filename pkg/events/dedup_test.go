@@ -0,0 +1,85 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"testing"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+const dedupWebhook = `{"event":"updated","timestamp":"2021-12-01 10:00:00.000000+00:00","model":"device","username":"admin","request_id":"0f3c","data":{"id":42,"name":"node001"}}`
+
+func TestEventID(t *testing.T) {
+	defaults := config.DeduplicationConfig{Fields: config.DefaultDeduplicationFields}
+	body := config.DeduplicationConfig{Fields: []string{config.DeduplicationBody}}
+	tests := []struct {
+		name  string
+		cfg   config.DeduplicationConfig
+		a, b  string
+		equal bool
+	}{
+		{"retried webhook", defaults, dedupWebhook, dedupWebhook, true},
+		{"other key order and whitespace", defaults, dedupWebhook,
+			`{"request_id": "0f3c", "model": "device", "event": "updated", "timestamp": "2021-12-01 10:00:00.000000+00:00", "data": {"name": "node001", "id": 42}, "username": "admin"}`, true},
+		{"fields not part of the id", defaults, dedupWebhook,
+			`{"event":"updated","timestamp":"2021-12-01 10:00:00.000000+00:00","model":"device","username":"other","request_id":"0f3c","data":{"id":42,"name":"node002"}}`, true},
+		{"other event", defaults, dedupWebhook,
+			`{"event":"deleted","timestamp":"2021-12-01 10:00:00.000000+00:00","model":"device","username":"admin","request_id":"0f3c","data":{"id":42,"name":"node001"}}`, false},
+		{"other object", defaults, dedupWebhook,
+			`{"event":"updated","timestamp":"2021-12-01 10:00:00.000000+00:00","model":"device","username":"admin","request_id":"0f3c","data":{"id":43,"name":"node001"}}`, false},
+		{"other request", defaults, dedupWebhook,
+			`{"event":"updated","timestamp":"2021-12-01 10:00:00.000000+00:00","model":"device","username":"admin","request_id":"0f3d","data":{"id":42,"name":"node001"}}`, false},
+		{"number and string differ", config.DeduplicationConfig{Fields: []string{"data.id"}},
+			`{"data":{"id":42}}`, `{"data":{"id":"42"}}`, false},
+		{"values do not shift into the next field", config.DeduplicationConfig{Fields: []string{"a", "b"}},
+			`{"a":"xy","b":"z"}`, `{"a":"x","b":"yz"}`, false},
+		{"missing fields", config.DeduplicationConfig{Fields: []string{"a", "b"}},
+			`{"a":null}`, `{}`, true},
+		{"body", body, dedupWebhook, dedupWebhook, true},
+		{"body with other whitespace", body, `{"id":1}`, `{"id": 1}`, false},
+	}
+	for _, tt := range tests {
+		a, err := eventID(tt.cfg, []byte(tt.a))
+		if err != nil {
+			t.Fatalf("%s: eventID error: %s", tt.name, err.Error())
+		}
+		b, err := eventID(tt.cfg, []byte(tt.b))
+		if err != nil {
+			t.Fatalf("%s: eventID error: %s", tt.name, err.Error())
+		}
+		if len(a) != 64 {
+			t.Errorf("%s: id %q is not a hex sha256", tt.name, a)
+		}
+		if (a == b) != tt.equal {
+			t.Errorf("%s: ids %s and %s, want equal %t", tt.name, a, b, tt.equal)
+		}
+	}
+}
+
+func TestEventIDDisabled(t *testing.T) {
+	id, err := eventID(config.DeduplicationConfig{Disabled: true, Fields: config.DefaultDeduplicationFields}, []byte(dedupWebhook))
+	if err != nil || id != "" {
+		t.Errorf("eventID = %q, %v, want no id", id, err)
+	}
+}
+
+func TestEventIDInvalidJSON(t *testing.T) {
+	if _, err := eventID(config.DeduplicationConfig{Fields: config.DefaultDeduplicationFields}, []byte(`{`)); err == nil {
+		t.Error("eventID of invalid json succeeded")
+	}
+}
@@ -0,0 +1,177 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/siddontang/go/log"
+)
+
+// fetchStaleAfter is the time after which a subscription, which did not fetch and is not
+// delivering an event, is considered stuck
+const fetchStaleAfter = 2 * time.Minute
+
+// HealthCheck returns an error if the checked component is not healthy
+type HealthCheck func() error
+
+type healthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// Health serves the liveness and readiness endpoints.
+// Liveness checks fail if only a restart helps, readiness checks fail if the component can not do its work right now.
+type Health struct {
+	live  []healthCheck
+	ready []healthCheck
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddLiveness adds a check to /healthz and /readyz
+func (h *Health) AddLiveness(name string, check HealthCheck) {
+	h.live = append(h.live, healthCheck{name, check})
+}
+
+// AddReadiness adds a check to /readyz
+func (h *Health) AddReadiness(name string, check HealthCheck) {
+	h.ready = append(h.ready, healthCheck{name, check})
+}
+
+// RegisterRoutes adds /healthz and /readyz to the router
+func (h *Health) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, h.live)
+	}).Methods("GET")
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, append(append([]healthCheck{}, h.live...), h.ready...))
+	}).Methods("GET")
+}
+
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+func (h *Health) respond(w http.ResponseWriter, checks []healthCheck) {
+	resp := healthResponse{Status: "ok", Checks: []checkResult{}}
+	status := http.StatusOK
+	for _, c := range checks {
+		res := checkResult{Name: c.name, OK: true}
+		if err := c.check(); err != nil {
+			res.OK, res.Error = false, err.Error()
+			resp.Status, status = "failed", http.StatusServiceUnavailable
+		}
+		resp.Checks = append(resp.Checks, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("write health response: %s", err.Error())
+	}
+}
+
+// NatsClosedCheck fails once the connection is closed, e.g. after all reconnects failed
+func NatsClosedCheck(nc *nats.Conn) HealthCheck {
+	return func() error {
+		if nc.IsClosed() {
+			return fmt.Errorf("nats connection is closed")
+		}
+		return nil
+	}
+}
+
+// NatsConnectedCheck fails while the connection is not established
+func NatsConnectedCheck(nc *nats.Conn) HealthCheck {
+	return func() error {
+		if s := nc.Status(); s != nats.CONNECTED {
+			return fmt.Errorf("nats connection is %s", s)
+		}
+		return nil
+	}
+}
+
+// StreamCheck fails if the NETBOX stream does not exist
+func StreamCheck(nc *nats.Conn) HealthCheck {
+	return func() error {
+		// do not wait for the request to time out
+		if !nc.IsConnected() {
+			return fmt.Errorf("nats is not connected")
+		}
+		js, err := nc.JetStream()
+		if err != nil {
+			return err
+		}
+		if _, err = js.StreamInfo(streamName); err != nil {
+			return fmt.Errorf("stream %s: %s", streamName, err.Error())
+		}
+		return nil
+	}
+}
+
+// subscriptionState tracks a subscription goroutine of a consumer
+type subscriptionState struct {
+	alive      int32
+	delivering int32
+	lastFetch  int64
+}
+
+func (s *subscriptionState) setAlive(alive bool) {
+	atomic.StoreInt32(&s.alive, boolInt(alive))
+}
+
+func (s *subscriptionState) startDelivering() {
+	atomic.AddInt32(&s.delivering, 1)
+}
+
+func (s *subscriptionState) doneDelivering() {
+	atomic.AddInt32(&s.delivering, -1)
+}
+
+func (s *subscriptionState) fetched() {
+	atomic.StoreInt64(&s.lastFetch, time.Now().UnixNano())
+}
+
+// stale is true if the subscription neither fetched recently nor is delivering events
+func (s *subscriptionState) stale() bool {
+	if atomic.LoadInt32(&s.delivering) > 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastFetch))) > fetchStaleAfter
+}
+
+func boolInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
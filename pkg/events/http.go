@@ -0,0 +1,109 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/tlsutil"
+	"github.com/siddontang/go/log"
+)
+
+// newHTTPClient creates the client shared by all requests of a distributor, so connections are reused.
+// The client has no timeout, each attempt is limited by the http timeout of the distributor.
+func newHTTPClient(name string, cfg config.HTTPClient) (client *http.Client, err error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: cfg.TLSHandshakeTimeout,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		DisableKeepAlives:   cfg.DisableKeepAlives,
+	}
+	if cfg.ProxyURL != "" {
+		proxy, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.TLS != nil {
+		if transport.TLSClientConfig, err = newTLSConfig(name, *cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// tokenTransport returns a pooled transport for the token endpoint, which is a different host than the recipient.
+// It keeps the proxy, timeouts and trusted CAs of the recipient, but neither its server name nor its client certificate.
+func tokenTransport(client *http.Client) http.RoundTripper {
+	recipient, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return http.DefaultTransport
+	}
+	t := recipient.Clone()
+	if c := recipient.TLSClientConfig; c != nil {
+		t.TLSClientConfig = &tls.Config{
+			MinVersion: c.MinVersion,
+			RootCAs:    c.RootCAs,
+		}
+	}
+	return t
+}
+
+func newTLSConfig(name string, t config.TLS) (c *tls.Config, err error) {
+	c = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.MinVersion != "" {
+		if c.MinVersion, err = tlsutil.ParseVersion(t.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if t.CAFile != "" {
+		// the system CAs are trusted as well, so recipients with public certificates keep working
+		if c.RootCAs, err = x509.SystemCertPool(); err != nil || c.RootCAs == nil {
+			c.RootCAs = x509.NewCertPool()
+		}
+		if err = tlsutil.AppendCAFile(c.RootCAs, t.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if t.CertFile != "" {
+		certs, err := tlsutil.NewCertReloader(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.GetClientCertificate = certs.GetClientCertificate
+	}
+	if t.InsecureSkipVerify {
+		log.Warnf("distributor %s does not verify the certificates of its recipient", name)
+	}
+	return c, nil
+}
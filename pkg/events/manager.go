@@ -0,0 +1,213 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/siddontang/go/log"
+)
+
+// stopTimeout limits waiting for the deliveries in progress of a consumer stopped by a config change.
+// Deliveries still in progress are nak'ed and redelivered, to the restarted consumer if the config changed.
+const stopTimeout = 30 * time.Second
+
+// retryFailedInterval is the interval to retry creating consumers which could not be created
+const retryFailedInterval = time.Minute
+
+// Manager runs a Consumer for every configured distributor
+type Manager struct {
+	nc *nats.Conn
+
+	// applyMu serializes Apply and Shutdown, mu protects the maps and is never held while consumers stop,
+	// so health checks are answered during a reload
+	applyMu   sync.Mutex
+	mu        sync.RWMutex
+	consumers map[string]*Consumer
+	// failed keeps the error of distributors whose consumer could not be created
+	failed map[string]error
+	// distributors is the config last applied
+	distributors []config.Distributor
+}
+
+func NewManager(nc *nats.Conn) *Manager {
+	return &Manager{
+		nc:        nc,
+		consumers: make(map[string]*Consumer),
+		failed:    make(map[string]error),
+	}
+}
+
+// Apply starts consumers for new distributors, stops the ones of removed distributors
+// and restarts the ones whose config changed. Unchanged consumers keep running.
+func (m *Manager) Apply(ctx context.Context, distributors []config.Distributor) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	wanted := make(map[string]config.Distributor, len(distributors))
+	for _, d := range distributors {
+		wanted[d.Name] = d
+	}
+	var stopped []*Consumer
+	m.mu.Lock()
+	m.distributors = distributors
+	for name := range m.failed {
+		if _, ok := wanted[name]; !ok {
+			delete(m.failed, name)
+		}
+	}
+	for name, c := range m.consumers {
+		d, ok := wanted[name]
+		if ok && reflect.DeepEqual(d, c.config) {
+			continue
+		}
+		if ok {
+			log.Infof("config of distributor %s changed. restarting consumer", name)
+		} else {
+			log.Infof("distributor %s removed. stopping consumer", name)
+		}
+		stopped = append(stopped, c)
+		delete(m.consumers, name)
+	}
+	m.mu.Unlock()
+
+	// the consumers have to be stopped before they are restarted, their metrics are registered under the same name
+	stopCtx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+	shutdown(stopCtx, stopped)
+	if ctx.Err() != nil {
+		return
+	}
+
+	for _, d := range distributors {
+		m.mu.RLock()
+		_, ok := m.consumers[d.Name]
+		m.mu.RUnlock()
+		if ok {
+			continue
+		}
+		c, err := NewConsumer(d, m.nc, ctx)
+		m.mu.Lock()
+		if err != nil {
+			log.Errorf("could not create consumer %s: %s", d.Name, err.Error())
+			m.failed[d.Name] = err
+		} else {
+			c.Subscribe(ctx)
+			m.consumers[d.Name] = c
+			delete(m.failed, d.Name)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Consumer returns the consumer of the distributor with the given name
+func (m *Manager) Consumer(name string) (*Consumer, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.consumers[name]
+	return c, ok
+}
+
+// RetryFailed periodically retries creating the consumers which could not be created,
+// e.g. because their stream was not reachable. Consumers failing because of their config
+// are retried as well, until the config is fixed.
+func (m *Manager) RetryFailed(ctx context.Context) {
+	ticker := time.NewTicker(retryFailedInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.RLock()
+		failed, distributors := len(m.failed), m.distributors
+		m.mu.RUnlock()
+		if failed > 0 {
+			log.Infof("retrying to create %d failed consumers", failed)
+			m.Apply(ctx, distributors)
+		}
+	}
+}
+
+// Live returns an error if a subscription of a consumer stopped.
+// Consumers which could not be created are reported by Ready, a restart does not fix them.
+func (m *Manager) Live() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.check(nil, (*Consumer).Live)
+}
+
+// Ready returns an error if a consumer could not be created or a subscription of a consumer is stuck
+func (m *Manager) Ready() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var problems []string
+	for name, err := range m.failed {
+		problems = append(problems, fmt.Sprintf("%s: %s", name, err.Error()))
+	}
+	return m.check(problems, (*Consumer).Ready)
+}
+
+func (m *Manager) check(problems []string, check func(c *Consumer) error) error {
+	for name, c := range m.consumers {
+		if err := check(c); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// Shutdown stops all consumers in parallel. Deliveries still in progress when ctx is done are aborted.
+func (m *Manager) Shutdown(ctx context.Context) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	m.mu.Lock()
+	consumers := make([]*Consumer, 0, len(m.consumers))
+	for name, c := range m.consumers {
+		consumers = append(consumers, c)
+		delete(m.consumers, name)
+	}
+	m.mu.Unlock()
+	shutdown(ctx, consumers)
+}
+
+// shutdown stops the consumers in parallel
+func shutdown(ctx context.Context, consumers []*Consumer) {
+	var wg sync.WaitGroup
+	for _, c := range consumers {
+		wg.Add(1)
+		go func(c *Consumer) {
+			defer wg.Done()
+			c.Shutdown(ctx)
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,166 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/tlsutil"
+	"github.com/siddontang/go/log"
+)
+
+var (
+	natsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "nats",
+		Name:      "connected",
+		Help:      "1 if the Nats connection is established, 0 while disconnected",
+	})
+	natsDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "nats",
+		Name:      "disconnects_total",
+		Help:      "Total number of times the Nats connection was lost",
+	})
+	natsReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "nats",
+		Name:      "reconnects_total",
+		Help:      "Total number of times the Nats connection was reestablished",
+	})
+	natsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "nats",
+		Name:      "async_errors_total",
+		Help:      "Total number of asynchronous Nats errors, e.g. slow consumers or permission violations",
+	})
+	registerNatsMetrics sync.Once
+)
+
+// Connect connects to Nats with the auth and tls of opts. Disconnects and reconnects are logged and counted.
+func Connect(name string, opts config.NatsOptions) (nc *nats.Conn, err error) {
+	if err = opts.Validate(); err != nil {
+		return
+	}
+	registerNatsMetrics.Do(func() {
+		prometheus.MustRegister(natsConnected, natsDisconnects, natsReconnects, natsErrors)
+	})
+	options := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(100),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			natsConnected.Set(0)
+			natsDisconnects.Inc()
+			if err != nil {
+				log.Warnf("disconnected from nats: %s", err.Error())
+			} else {
+				log.Warn("disconnected from nats")
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			natsConnected.Set(1)
+			natsReconnects.Inc()
+			log.Infof("reconnected to nats %s", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			natsConnected.Set(0)
+			if err := nc.LastError(); err != nil {
+				log.Errorf("nats connection closed: %s", err.Error())
+			} else {
+				log.Info("nats connection closed")
+			}
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			natsErrors.Inc()
+			if sub != nil {
+				log.Errorf("nats error on %s: %s", sub.Subject, err.Error())
+			} else {
+				log.Errorf("nats error: %s", err.Error())
+			}
+		}),
+	}
+	switch {
+	case opts.User != "" || opts.Password != "":
+		options = append(options, nats.UserInfo(opts.User, opts.Password))
+	case opts.Token != "":
+		options = append(options, nats.Token(opts.Token))
+	case opts.NKeySeedFile != "":
+		option, err := nats.NkeyOptionFromSeed(opts.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	case opts.CredentialsFile != "":
+		options = append(options, nats.UserCredentials(opts.CredentialsFile))
+	}
+	if opts.CAFile != "" || opts.CertFile != "" {
+		tlsConfig, err := natsTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.Secure(tlsConfig))
+	}
+	if nc, err = nats.Connect(opts.URL, options...); err != nil {
+		return
+	}
+	natsConnected.Set(1)
+	log.Infof("connected to nats %s", nc.ConnectedUrl())
+	return
+}
+
+// natsTLSConfig trusts the CA file in addition to the system CAs and presents the client certificate,
+// which is reloaded when its files change
+func natsTLSConfig(opts config.NatsOptions) (c *tls.Config, err error) {
+	c = &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		if c.RootCAs, err = x509.SystemCertPool(); err != nil || c.RootCAs == nil {
+			c.RootCAs = x509.NewCertPool()
+		}
+		if err = tlsutil.AppendCAFile(c.RootCAs, opts.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CertFile != "" {
+		certs, err := tlsutil.NewCertReloader(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.GetClientCertificate = certs.GetClientCertificate
+	}
+	return c, nil
+}
+
+// Drain drains the connection, so pending acks and publishes are flushed, and waits until it is closed or ctx is done
+func Drain(ctx context.Context, nc *nats.Conn) (err error) {
+	if err = nc.Drain(); err != nil {
+		return
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !nc.IsClosed() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return
+}
@@ -20,48 +20,35 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// WebhookBody holds the fields of a Netbox webhook needed for routing.
+// Webhooks are distributed exactly as received, fields not listed here are kept.
 type WebhookBody struct {
-	Event     string
-	Timestamp string
-	Model     string
-	Username  string
-	Data      data
-	Snapshots snapshot `json:"snapshots"`
+	Event     string `json:"event"`
+	Timestamp string `json:"timestamp"`
+	Model     string `json:"model"`
+	Username  string `json:"username"`
+	RequestID string `json:"request_id"`
+	Data      data   `json:"data"`
 }
 
 type data struct {
-	ID       int
-	Name     string
-	Region   string
-	Role     role `json:"device_role"`
-	Status   status
-	Comments string
-	Site     site
-}
-
-type role struct {
-	Display string
-	Slug    string
-	ID      int `json:"id"`
-}
-
-type status struct {
-	Value string
-	Label string
+	ID int `json:"id"`
+	// Slug is the slug of the object, for sites the site slug
+	Slug string `json:"slug"`
+	Site site   `json:"site"`
+	// Region is set for objects belonging directly to a region, e.g. sites
+	Region slugRef `json:"region"`
 }
 
 type site struct {
 	ID   int    `json:"id"`
 	Slug string `json:"slug"`
+	// Region is only set if Netbox includes it in the nested site
+	Region slugRef `json:"region"`
 }
 
-type snapshot struct {
-	PreChange  change `json:"prechange"`
-	PostChange change `json:"postchange"`
-}
-
-type change struct {
-	Status string `json:"status"`
+type slugRef struct {
+	Slug string `json:"slug"`
 }
 
 type Webhook struct {
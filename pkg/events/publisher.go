@@ -17,12 +17,19 @@
 package events
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
-	"unicode/utf8"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
 	"github.com/siddontang/go/log"
 
 	"github.com/gorilla/mux"
@@ -35,54 +42,138 @@ const (
 )
 
 type Publisher struct {
-	js     nats.JetStreamContext
-	Router *mux.Router
+	js      nats.JetStreamContext
+	secrets [][]byte
+	regions *RegionResolver
+	dedup   config.DeduplicationConfig
+	maxBody int64
+	Router  *mux.Router
+	// RequireClientCert rejects webhooks sent without a client certificate verified by the TLS listener
+	RequireClientCert bool
+
+	unauthorizedRequests *prometheus.CounterVec
+	unresolvedRegions    *prometheus.CounterVec
+	deduplicated         *prometheus.CounterVec
+	responses            *prometheus.CounterVec
+	published            *prometheus.CounterVec
+	publishErrors        *prometheus.CounterVec
+	publishDuration      prometheus.Histogram
+	bodySize             prometheus.Histogram
 }
 
-func NewPublisher(nc *nats.Conn) (p *Publisher, err error) {
+// NewPublisher creates the NETBOX stream and registers the webhook handler.
+// If secrets are given, every webhook has to carry a valid Netbox signature.
+func NewPublisher(nc *nats.Conn, cfg config.WebhookConfig, secrets []string) (p *Publisher, err error) {
 	js, err := nc.JetStream()
 	if err != nil {
 		return
 	}
+	regions, err := NewRegionResolver(cfg.Regions)
+	if err != nil {
+		return
+	}
 	p = &Publisher{
-		js:     js,
-		Router: mux.NewRouter(),
+		js:      js,
+		regions: regions,
+		dedup:   cfg.Deduplication,
+		maxBody: cfg.MaxBodySize,
+		Router:  mux.NewRouter(),
+		unauthorizedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "unauthorized_requests_total",
+			Help:      "Total number of webhooks rejected because of a missing or invalid signature or client certificate",
+		}, []string{"reason"}),
+		unresolvedRegions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "unresolved_region_total",
+			Help:      "Total number of webhooks whose region could not be resolved",
+		}, []string{"model"}),
+		deduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "deduplicated_total",
+			Help:      "Total number of webhooks dropped as duplicates of an earlier webhook",
+		}, []string{"model"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "responses_total",
+			Help:      "Total number of webhook responses by http status code",
+		}, []string{"code"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "events_total",
+			Help:      "Total number of webhooks published to the stream",
+		}, []string{"model", "event", "region"}),
+		publishErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "webhook",
+			Name:      "publish_errors_total",
+			Help:      "Total number of webhooks which could not be published to the stream",
+		}, []string{"reason"}),
+		publishDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "webhook",
+			Name:      "publish_duration_seconds",
+			Help:      "Time until JetStream acknowledged a published webhook",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		bodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "webhook",
+			Name:      "request_size_bytes",
+			Help:      "Size of the received webhooks",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}),
+	}
+	for _, s := range secrets {
+		p.secrets = append(p.secrets, []byte(s))
+	}
+	if len(p.secrets) == 0 {
+		log.Warn("no webhook secrets configured. accepting unsigned webhooks")
+	}
+	for _, col := range []prometheus.Collector{p.unauthorizedRequests, p.unresolvedRegions, p.deduplicated,
+		p.responses, p.published, p.publishErrors, p.publishDuration, p.bodySize} {
+		if err = prometheus.Register(col); err != nil {
+			return
+		}
 	}
-	if err = p.createStream(); err != nil {
+	if err = p.createStream(cfg.Stream); err != nil {
 		return
 	}
 	p.Router.HandleFunc("/handler/netbox/webhook", p.webhookHandler).Methods("POST")
 	return
 }
 
-func (p *Publisher) publish(subj string, data []byte) (err error) {
+// publish publishes an event to the stream. Events with an id already published
+// within the duplicate window of the stream are dropped by JetStream.
+func (p *Publisher) publish(subj string, data []byte, id string) (ack *nats.PubAck, err error) {
 	log.Debug("publishing new event")
-	_, err = p.js.Publish(subj, data)
-	return
+	defer func(start time.Time) {
+		p.publishDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	var opts []nats.PubOpt
+	if id != "" {
+		opts = append(opts, nats.MsgId(id))
+	}
+	return p.js.Publish(subj, data, opts...)
 }
 
-func (p *Publisher) createStream() (err error) {
+// createStream creates the NETBOX stream or updates it to the configured settings
+func (p *Publisher) createStream(cfg config.StreamConfig) (err error) {
+	wanted := streamConfig(cfg)
 	stream, _ := p.js.StreamInfo(streamName)
 	if stream == nil {
 		log.Debugf("creating stream %q and subjects %q", streamName, streamSubjects)
-		_, err = p.js.AddStream(&nats.StreamConfig{
-			Name:     streamName,
-			Subjects: []string{streamSubjects},
-			MaxAge:   1 * time.Hour,
-		})
-		if err != nil {
-			return
-		}
-	} else {
-		_, err = p.js.UpdateStream(&nats.StreamConfig{
-			Name:     streamName,
-			Subjects: []string{streamSubjects},
-			MaxAge:   1 * time.Hour,
-		})
-		if err != nil {
-			return
-		}
+		_, err = p.js.AddStream(wanted)
+		return
+	}
+	if stream.Config.Storage != wanted.Storage {
+		log.Errorf("storage of stream %q can not be changed from %s to %s, the stream has to be recreated. keeping %s",
+			streamName, stream.Config.Storage, wanted.Storage, stream.Config.Storage)
+		wanted.Storage = stream.Config.Storage
+	}
+	diff := streamDiff(&stream.Config, wanted)
+	if len(diff) == 0 {
+		return
 	}
+	log.Infof("updating stream %q: %s", streamName, strings.Join(diff, ", "))
+	_, err = p.js.UpdateStream(wanted)
 	return
 }
 
@@ -90,28 +181,139 @@ func (p *Publisher) webhookHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	wb := WebhookBody{}
 
-	if err := json.NewDecoder(r.Body).Decode(&wb); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if p.RequireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		log.Warnf("rejecting webhook without client certificate from %s", r.RemoteAddr)
+		p.unauthorizedRequests.WithLabelValues("missing_client_certificate").Inc()
+		p.respondError(w, http.StatusUnauthorized, errors.New("missing client certificate"))
+		return
+	}
+	if r.ContentLength > p.maxBody {
+		p.respondError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("webhook exceeds %d bytes", p.maxBody))
+		return
+	}
+	// read one byte more than allowed to detect bodies without a content length exceeding the limit
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, p.maxBody+1))
+	if err != nil {
+		p.respondError(w, http.StatusBadRequest, fmt.Errorf("read webhook: %s", err.Error()))
+		return
+	}
+	p.bodySize.Observe(float64(len(body)))
+	if int64(len(body)) > p.maxBody {
+		p.respondError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("webhook exceeds %d bytes", p.maxBody))
+		return
+	}
+	if !p.authorized(r, body) {
+		p.respondError(w, http.StatusUnauthorized, errors.New("missing or invalid signature"))
+		return
+	}
+
+	if err = json.Unmarshal(body, &wb); err != nil {
+		p.respondError(w, http.StatusBadRequest, fmt.Errorf("invalid webhook json: %s", err.Error()))
+		return
+	}
+	if wb.Model == "" || wb.Event == "" {
+		p.respondError(w, http.StatusUnprocessableEntity, errors.New("webhook has no model or event"))
+		return
+	}
+	// the model is a token of the subject, a model like "a.b" or "*" would be published outside of NETBOX.*.*
+	if invalidTokenRx.MatchString(wb.Model) {
+		p.respondError(w, http.StatusUnprocessableEntity, fmt.Errorf("webhook model %q can not be routed", wb.Model))
+		return
+	}
+	region, resolved := p.regions.Resolve(wb)
+	if !resolved {
+		p.unresolvedRegions.WithLabelValues(wb.Model).Inc()
+		log.Warnf("could not resolve region of %s %d, site %q", wb.Model, wb.Data.ID, wb.Data.Site.Slug)
+		if region == "" {
+			p.respondError(w, http.StatusUnprocessableEntity, fmt.Errorf("could not resolve region of %s %d", wb.Model, wb.Data.ID))
+			return
+		}
 	}
-	region := getRegionFromSite(wb.Data.Site.Slug)
-	log.Debugf("incoming webhook event: %s, region: %s, device-name: %s, status: %s, role: %s",
-		wb.Event, region, wb.Data.Name, wb.Data.Status.Value, wb.Data.Role.Slug)
+	log.Debugf("incoming webhook event: %s, region: %s, model: %s, id: %d, request-id: %s",
+		wb.Event, region, wb.Model, wb.Data.ID, wb.RequestID)
 
-	data, err := json.Marshal(wb)
+	id, err := eventID(p.dedup, body)
+	if err != nil {
+		log.Errorf("could not derive event id, not deduplicating: %s", err.Error())
+	}
+	// publish the webhook as received, so recipients get exactly what Netbox sent
+	ack, err := p.publish(fmt.Sprintf("NETBOX.%s.%s", region, wb.Model), body, id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		status, reason := http.StatusInternalServerError, "error"
+		if isUnavailableError(err) {
+			status, reason = http.StatusServiceUnavailable, "unavailable"
+		}
+		p.publishErrors.WithLabelValues(reason).Inc()
+		p.respondError(w, status, fmt.Errorf("publish event: %s", err.Error()))
+		return
 	}
-	if err = p.publish(fmt.Sprintf("NETBOX.%s.%s", region, wb.Model), data); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if ack.Duplicate {
+		log.Debugf("dropped duplicate webhook event: %s, model: %s, id: %d", wb.Event, wb.Model, wb.Data.ID)
+		p.deduplicated.WithLabelValues(wb.Model).Inc()
+	} else {
+		p.published.WithLabelValues(wb.Model, wb.Event, region).Inc()
 	}
 
-	w.WriteHeader(http.StatusOK)
+	p.respond(w, http.StatusOK, nil)
+}
+
+// errorResponse is the body of a rejected webhook
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
 }
 
-func getRegionFromSite(site string) string {
-	r, s := utf8.DecodeLastRuneInString(site)
-	if r == utf8.RuneError && (s == 0 || s == 1) {
-		s = 0
+// respondError rejects a webhook. Netbox retries webhooks answered with a status other than 2xx.
+func (p *Publisher) respondError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Errorf("webhook failed: %s", err.Error())
+	} else {
+		log.Warnf("webhook rejected: %s", err.Error())
+	}
+	p.respond(w, status, errorResponse{Error: err.Error(), Status: status})
+}
+
+func (p *Publisher) respond(w http.ResponseWriter, status int, body interface{}) {
+	p.responses.WithLabelValues(strconv.Itoa(status)).Inc()
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("write webhook response: %s", err.Error())
+	}
+}
+
+// isUnavailableError is true if JetStream could not be reached, so the webhook may succeed later.
+// Publishing returns ErrNoStreamResponse if JetStream or the stream is down.
+func isUnavailableError(err error) bool {
+	for _, unavailable := range []error{nats.ErrNoStreamResponse, nats.ErrNoResponders, nats.ErrTimeout,
+		nats.ErrConnectionClosed, nats.ErrConnectionDraining, nats.ErrConnectionReconnecting, nats.ErrDisconnected,
+		nats.ErrJetStreamNotEnabled, context.DeadlineExceeded} {
+		if errors.Is(err, unavailable) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized verifies the Netbox signature of the request body, if secrets are configured
+func (p *Publisher) authorized(r *http.Request, body []byte) bool {
+	if len(p.secrets) == 0 {
+		return true
+	}
+	sig := r.Header.Get(signatureHeader)
+	if sig == "" {
+		log.Warnf("rejecting unsigned webhook from %s", r.RemoteAddr)
+		p.unauthorizedRequests.WithLabelValues("missing_signature").Inc()
+		return false
+	}
+	if !verifySignature(body, sig, p.secrets) {
+		log.Warnf("rejecting webhook with invalid signature from %s", r.RemoteAddr)
+		p.unauthorizedRequests.WithLabelValues("invalid_signature").Inc()
+		return false
 	}
-	return site[:len(site)-s]
+	return true
 }
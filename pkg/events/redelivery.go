@@ -0,0 +1,125 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siddontang/go/log"
+)
+
+// redeliveryAckWait is the ack wait of durable consumers in redelivery mode.
+// An event not acked or nak'ed in time, e.g. because the distributor crashed, is redelivered.
+const redeliveryAckWait = 30 * time.Second
+
+// maxDeliveriesAdvisory is published by JetStream for events which exceeded the max deliveries of a consumer
+const maxDeliveriesAdvisory = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s"
+
+type maxDeliveries struct {
+	Stream     string    `json:"stream"`
+	Consumer   string    `json:"consumer"`
+	StreamSeq  uint64    `json:"stream_seq"`
+	Deliveries uint64    `json:"deliveries"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// deliverOnce dispatches the event once, JetStream redelivers it if it is nak'ed
+func (c *Consumer) deliverOnce(ctx context.Context, msg *nats.Msg) (d delivery) {
+	log.Debugf("dispatching: %s, %s", msg.Subject, c.sink)
+	d.attempt()
+	m, err := c.message(msg)
+	if err != nil {
+		d.err = err
+		return
+	}
+	if meta, _ := msg.Metadata(); meta != nil && meta.NumDelivered > 1 {
+		d.attempts = int(meta.NumDelivered)
+		// the first attempt happened in an earlier delivery
+		d.firstAttempt = time.Time{}
+	}
+	d.err = c.dispatch(ctx, m, d.attempts)
+	return
+}
+
+// redeliver naks a failed event with the delay of the retry policy, unless the error is not retried,
+// the max deliveries are used up, the recipient asked to wait longer than the max delay
+// or the redelivery would exceed the max duration.
+// It returns false if the event has to be dead-lettered.
+func (c *Consumer) redeliver(msg *nats.Msg, d delivery) bool {
+	meta, err := msg.Metadata()
+	if err != nil || !c.retry.retryable(d.err) || d.attempts >= c.retry.Steps {
+		return false
+	}
+	delay, ok := c.retry.delay(d.attempts, d.err)
+	if !ok {
+		return false
+	}
+	if c.retry.MaxDuration > 0 && time.Since(meta.Timestamp)+delay > c.retry.MaxDuration {
+		return false
+	}
+	log.Debugf("delivery %d of %s to %s failed: %s. redelivering in %s", d.attempts, msg.Subject, c.name, d.err.Error(), delay)
+	if err = nakWithDelay(msg, delay); err != nil {
+		log.Errorf("nak error: %s", err)
+	}
+	c.distributionRedeliveries.Inc()
+	return true
+}
+
+// nakWithDelay asks JetStream to redeliver the event after delay, which needs nats-server 2.7 or newer
+func nakWithDelay(msg *nats.Msg, delay time.Duration) error {
+	return msg.Respond([]byte(fmt.Sprintf(`-NAK {"delay": %d}`, delay.Nanoseconds())))
+}
+
+// deadLetterMaxDeliveries moves events to the dead-letter stream, which exceeded the max deliveries
+// without the distributor giving up on them, e.g. because it crashed during the last delivery.
+// Advisories published while the distributor is not running are missed.
+func (c *Consumer) deadLetterMaxDeliveries(ctx context.Context, nc *nats.Conn, durable, object string) {
+	sub, err := nc.Subscribe(fmt.Sprintf(maxDeliveriesAdvisory, streamName, durable), func(m *nats.Msg) {
+		adv := maxDeliveries{}
+		if err := json.Unmarshal(m.Data, &adv); err != nil {
+			log.Errorf("max deliveries advisory unmarshal error %s", err.Error())
+			return
+		}
+		raw, err := c.js.GetMsg(streamName, adv.StreamSeq)
+		if err != nil {
+			log.Errorf("could not get event %d exceeding max deliveries of %s: %s", adv.StreamSeq, durable, err.Error())
+			return
+		}
+		d := delivery{
+			attempts:    int(adv.Deliveries),
+			lastAttempt: adv.Timestamp,
+			err:         errors.New("exceeded max deliveries"),
+		}
+		if err = c.publishDeadLetter(raw.Subject, raw.Data, raw.Sequence, raw.Time, object, d); err != nil {
+			log.Errorf("could not move event %d to dead-letter stream: %s", adv.StreamSeq, err.Error())
+			return
+		}
+		log.Errorf("event %d exceeded max deliveries to %s. moved event to dead-letter stream", adv.StreamSeq, c.name)
+		c.distributionDeadLetters.Inc()
+	})
+	if err != nil {
+		log.Errorf("could not subscribe to max deliveries advisories of %s: %s", durable, err.Error())
+		return
+	}
+	<-ctx.Done()
+	sub.Unsubscribe()
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"regexp"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// invalidTokenRx matches characters, which may not appear in a nats subject token
+var invalidTokenRx = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// RegionResolver derives the region of an event, which is part of the subject it is published to
+type RegionResolver struct {
+	cfg   config.RegionConfig
+	rules []*regexp.Regexp
+}
+
+func NewRegionResolver(cfg config.RegionConfig) (r *RegionResolver, err error) {
+	r = &RegionResolver{cfg: cfg}
+	for _, rule := range cfg.Rules {
+		rx, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rx)
+	}
+	return
+}
+
+// Resolve returns the region of the event. resolved is false if the fallback was used,
+// region is empty if the event could not be resolved and unresolved events are rejected.
+func (r *RegionResolver) Resolve(wb WebhookBody) (region string, resolved bool) {
+	if region = r.resolve(wb); region != "" {
+		return invalidTokenRx.ReplaceAllString(region, "_"), true
+	}
+	if r.cfg.RejectUnresolved {
+		return "", false
+	}
+	return r.cfg.Fallback, false
+}
+
+func (r *RegionResolver) resolve(wb WebhookBody) string {
+	slug := wb.Data.Site.Slug
+	if wb.Model == "site" {
+		// the object is the site itself
+		slug = wb.Data.Slug
+	}
+	if slug != "" {
+		if region, ok := r.cfg.Sites[slug]; ok {
+			return region
+		}
+		for _, rx := range r.rules {
+			if region := matchRegion(rx, slug); region != "" {
+				return region
+			}
+		}
+	}
+	if r.cfg.NetboxRegion {
+		if wb.Data.Site.Region.Slug != "" {
+			return wb.Data.Site.Region.Slug
+		}
+		if wb.Data.Region.Slug != "" {
+			return wb.Data.Region.Slug
+		}
+	}
+	return ""
+}
+
+// matchRegion returns the group named region, the first group or the whole match
+func matchRegion(rx *regexp.Regexp, slug string) string {
+	m := rx.FindStringSubmatch(slug)
+	if m == nil {
+		return ""
+	}
+	if i := rx.SubexpIndex("region"); i > 0 {
+		return m[i]
+	}
+	if len(m) > 1 {
+		return m[1]
+	}
+	return m[0]
+}
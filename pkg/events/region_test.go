@@ -0,0 +1,85 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+func TestRegionResolver(t *testing.T) {
+	defaults := config.RegionConfig{
+		Rules:    config.DefaultRegionRules,
+		Fallback: config.DefaultRegionFallback,
+	}
+	custom := config.RegionConfig{
+		Sites:        map[string]string{"lab1": "qa-de-1", "qa-de-1a": "qa-de-2"},
+		Rules:        []string{`^x-(eu)-`, `^[a-z]+-[a-z]+$`},
+		NetboxRegion: true,
+		Fallback:     "global",
+	}
+	reject := config.RegionConfig{
+		Rules:            config.DefaultRegionRules,
+		RejectUnresolved: true,
+	}
+	tests := []struct {
+		name     string
+		cfg      config.RegionConfig
+		webhook  string
+		region   string
+		resolved bool
+	}{
+		{"default rule", defaults, `{"model":"device","data":{"site":{"slug":"qa-de-1a"}}}`, "qa-de-1", true},
+		{"default rule, several digits and letters", defaults, `{"model":"device","data":{"site":{"slug":"ap-jp-12ab"}}}`, "ap-jp-12", true},
+		{"site events use their own slug", defaults, `{"model":"site","data":{"slug":"eu-nl-1b"}}`, "eu-nl-1", true},
+		{"site slug not matching", defaults, `{"model":"device","data":{"site":{"slug":"lab1"}}}`, "global", false},
+		{"fallback without site", defaults, `{"model":"tenant","data":{"slug":"t1"}}`, "global", false},
+		{"netbox region disabled", defaults, `{"model":"device","data":{"site":{"slug":"lab1","region":{"slug":"qa-de-1"}}}}`, "global", false},
+		{"static site before rules", custom, `{"model":"device","data":{"site":{"slug":"qa-de-1a"}}}`, "qa-de-2", true},
+		{"static site", custom, `{"model":"device","data":{"site":{"slug":"lab1"}}}`, "qa-de-1", true},
+		{"first group", custom, `{"model":"device","data":{"site":{"slug":"x-eu-1"}}}`, "eu", true},
+		{"whole match", custom, `{"model":"device","data":{"site":{"slug":"lab-two"}}}`, "lab-two", true},
+		{"region of the nested site", custom, `{"model":"device","data":{"site":{"slug":"lab3","region":{"slug":"qa-de-3"}}}}`, "qa-de-3", true},
+		{"region of the object", custom, `{"model":"site","data":{"slug":"lab3","region":{"slug":"qa-de-4"}}}`, "qa-de-4", true},
+		{"invalid subject characters replaced", custom, `{"model":"device","data":{"site":{"slug":"lab3","region":{"slug":"qa.de 1"}}}}`, "qa_de_1", true},
+		{"no source matches", custom, `{"model":"device","data":{"site":{"slug":"lab3"}}}`, "global", false},
+		{"rejected", reject, `{"model":"tenant","data":{}}`, "", false},
+		{"resolved although rejecting", reject, `{"model":"device","data":{"site":{"slug":"qa-de-1a"}}}`, "qa-de-1", true},
+	}
+	for _, tt := range tests {
+		r, err := NewRegionResolver(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wb := WebhookBody{}
+		if err := json.Unmarshal([]byte(tt.webhook), &wb); err != nil {
+			t.Fatal(err)
+		}
+		region, resolved := r.Resolve(wb)
+		if region != tt.region || resolved != tt.resolved {
+			t.Errorf("%s: Resolve = %q, %t, want %q, %t", tt.name, region, resolved, tt.region, tt.resolved)
+		}
+	}
+}
+
+func TestRegionResolverInvalidRule(t *testing.T) {
+	if _, err := NewRegionResolver(config.RegionConfig{Rules: []string{"("}}); err == nil {
+		t.Error("NewRegionResolver with an invalid rule succeeded")
+	}
+}
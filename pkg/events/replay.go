@@ -0,0 +1,177 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siddontang/go/log"
+)
+
+// replayIdleTimeout ends a replay if no further event arrives
+const replayIdleTimeout = 5 * time.Second
+
+// replay result of a single event
+const (
+	ReplaySent     = "sent"
+	ReplayFailed   = "failed"
+	ReplaySkipped  = "skipped"
+	ReplayFiltered = "filtered"
+	ReplayDryRun   = "dry-run"
+)
+
+type ReplayOptions struct {
+	Region string
+	Object string
+	// StartSequence or StartTime select the first event to replay.
+	// If both are empty, all events in the stream are replayed.
+	StartSequence uint64
+	StartTime     time.Time
+	// DryRun only lists the events which would be sent
+	DryRun bool
+}
+
+type ReplayEvent struct {
+	Sequence  uint64    `json:"sequence"`
+	Subject   string    `json:"subject"`
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Model     string    `json:"model"`
+	ObjectID  int       `json:"object_id"`
+	Result    string    `json:"result"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type ReplaySummary struct {
+	Sent     int `json:"sent"`
+	Failed   int `json:"failed"`
+	Skipped  int `json:"skipped"`
+	Filtered int `json:"filtered"`
+	DryRun   int `json:"dry_run"`
+}
+
+func (s *ReplaySummary) add(e ReplayEvent) {
+	switch e.Result {
+	case ReplaySent:
+		s.Sent++
+	case ReplayFailed:
+		s.Failed++
+	case ReplaySkipped:
+		s.Skipped++
+	case ReplayFiltered:
+		s.Filtered++
+	case ReplayDryRun:
+		s.DryRun++
+	}
+}
+
+// Replay re-dispatches the events of an object stored in the NETBOX stream to the recipient.
+// It uses an ephemeral consumer, so the state of the durable consumers is not touched.
+// progress is called for every event.
+func (c *Consumer) Replay(ctx context.Context, opts ReplayOptions, progress func(ReplayEvent)) (sum ReplaySummary, err error) {
+	if _, ok := c.config.NetboxWebhooks[opts.Object]; !ok {
+		return sum, fmt.Errorf("distributor %s is not subscribed to %q", c.name, opts.Object)
+	}
+	if opts.Region == "" {
+		opts.Region = c.config.Region
+	}
+	if invalidTokenRx.MatchString(opts.Region) {
+		return sum, fmt.Errorf("invalid region %q", opts.Region)
+	}
+	subOpts := []nats.SubOpt{nats.AckNone()}
+	switch {
+	case opts.StartSequence > 0:
+		subOpts = append(subOpts, nats.StartSequence(opts.StartSequence))
+	case !opts.StartTime.IsZero():
+		subOpts = append(subOpts, nats.StartTime(opts.StartTime))
+	default:
+		subOpts = append(subOpts, nats.DeliverAll())
+	}
+	subj := fmt.Sprintf("NETBOX.%s.%s", opts.Region, opts.Object)
+	log.Infof("replaying %s to %s (dry-run: %t)", subj, c.name, opts.DryRun)
+	sub, err := c.js.SubscribeSync(subj, subOpts...)
+	if err != nil {
+		return
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return
+	}
+	// messages are pushed right away, some may already be delivered to the subscription
+	pending := info.NumPending + info.Delivered.Consumer
+	for pending > 0 {
+		mctx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		msg, err := sub.NextMsgWithContext(mctx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return sum, nil
+			}
+			return sum, err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return sum, err
+		}
+		pending = meta.NumPending
+		e := c.replay(ctx, msg, opts)
+		e.Sequence = meta.Sequence.Stream
+		e.Timestamp = meta.Timestamp
+		sum.add(e)
+		progress(e)
+	}
+	return
+}
+
+func (c *Consumer) replay(ctx context.Context, msg *nats.Msg, opts ReplayOptions) (e ReplayEvent) {
+	e.Subject = msg.Subject
+	wb := WebhookBody{}
+	if err := json.Unmarshal(msg.Data, &wb); err != nil {
+		e.Result = ReplaySkipped
+		e.Error = err.Error()
+		return
+	}
+	e.Event = wb.Event
+	e.Model = wb.Model
+	e.ObjectID = wb.Data.ID
+	switch {
+	case !c.wants(opts.Object, wb.Event):
+		e.Result = ReplaySkipped
+	case !c.matches(msg):
+		e.Result = ReplayFiltered
+	case opts.DryRun:
+		e.Result = ReplayDryRun
+	default:
+		d := c.deliver(ctx, msg)
+		e.Attempts = d.attempts
+		if d.err != nil {
+			e.Result = ReplayFailed
+			e.Error = d.err.Error()
+			return
+		}
+		e.Result = ReplaySent
+	}
+	return
+}
@@ -0,0 +1,142 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/siddontang/go/log"
+)
+
+// retryPolicy retries failed deliveries with an exponential backoff
+type retryPolicy struct {
+	config.Retry
+	statusCodes map[int]bool
+}
+
+func newRetryPolicy(r config.Retry) *retryPolicy {
+	p := &retryPolicy{Retry: r, statusCodes: make(map[int]bool, len(r.StatusCodes))}
+	for _, code := range r.StatusCodes {
+		p.statusCodes[code] = true
+	}
+	return p
+}
+
+// do calls fn until it succeeds, fails with an error which is not retried, the attempts are used up,
+// the recipient asks to wait longer than MaxDelay, the next delay would exceed MaxDuration or ctx is done.
+// It returns the last error.
+func (p *retryPolicy) do(ctx context.Context, fn func() error) (err error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return
+		}
+		if attempt >= p.Steps || !p.retryable(err) || ctx.Err() != nil {
+			return
+		}
+		wait, ok := p.delay(attempt, err)
+		if !ok {
+			return
+		}
+		if p.MaxDuration > 0 && time.Since(start)+wait > p.MaxDuration {
+			return
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// redelivery is true if failed events are retried by JetStream redelivering them
+func (p *retryPolicy) redelivery() bool {
+	return p.Mode == config.RetryRedelivery
+}
+
+// delay returns the delay after the given attempt, starting at 1, or the Retry-After of err.
+// ok is false if the recipient asked to wait longer than MaxDelay, the event is not retried then,
+// because retrying earlier than asked would only be rejected again.
+func (p *retryPolicy) delay(attempt int, err error) (d time.Duration, ok bool) {
+	if ra := retryAfter(err); ra > 0 {
+		if p.MaxDelay > 0 && ra > p.MaxDelay {
+			log.Warnf("recipient asked to retry after %s, more than the max delay of %s. giving up", ra, p.MaxDelay)
+			return 0, false
+		}
+		return ra, true
+	}
+	d = p.jitter(time.Duration(float64(p.Base) * math.Pow(p.Factor, float64(attempt-1))))
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d, true
+}
+
+func (p *retryPolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*p.Jitter*float64(d))
+}
+
+// retryable is true for timeouts, refused connections, nats being unavailable
+// and the configured http status codes
+func (p *retryPolicy) retryable(err error) bool {
+	if err, ok := err.(*DispatchError); ok && err.StatusCode != 0 {
+		return p.statusCodes[err.StatusCode]
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrNoResponders) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// retryAfter returns the delay the recipient asked for, if any
+func retryAfter(err error) time.Duration {
+	if err, ok := err.(*DispatchError); ok {
+		return err.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses the Retry-After header, given in seconds or as http date
+func parseRetryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+func testRetryPolicy() *retryPolicy {
+	return newRetryPolicy(config.Retry{
+		Mode:        config.RetryInProcess,
+		Steps:       5,
+		Base:        100 * time.Millisecond,
+		Factor:      2,
+		MaxDelay:    time.Second,
+		StatusCodes: []int{429, 503},
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		err     error
+		want    time.Duration
+		ok      bool
+	}{
+		{1, errors.New("failed"), 100 * time.Millisecond, true},
+		{2, errors.New("failed"), 200 * time.Millisecond, true},
+		{4, errors.New("failed"), 800 * time.Millisecond, true},
+		// capped by the max delay
+		{5, errors.New("failed"), time.Second, true},
+		{20, errors.New("failed"), time.Second, true},
+		// the Retry-After of the recipient replaces the backoff
+		{1, &DispatchError{StatusCode: 429, RetryAfter: 700 * time.Millisecond}, 700 * time.Millisecond, true},
+		{1, &DispatchError{StatusCode: 429, RetryAfter: time.Second}, time.Second, true},
+		// waiting longer than the max delay is not retried
+		{1, &DispatchError{StatusCode: 429, RetryAfter: 60 * time.Second}, 0, false},
+		{1, &DispatchError{StatusCode: 503}, 100 * time.Millisecond, true},
+	}
+	p := testRetryPolicy()
+	for _, tt := range tests {
+		got, ok := p.delay(tt.attempt, tt.err)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("delay(%d, %v) = %s, %t, want %s, %t", tt.attempt, tt.err, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryDelayWithoutMaxDelay(t *testing.T) {
+	p := testRetryPolicy()
+	p.MaxDelay = 0
+	if got, ok := p.delay(1, &DispatchError{StatusCode: 429, RetryAfter: time.Hour}); got != time.Hour || !ok {
+		t.Errorf("delay = %s, %t, want 1h, true", got, ok)
+	}
+	if got, _ := p.delay(10, errors.New("failed")); got != 100*time.Millisecond*512 {
+		t.Errorf("delay = %s, want it not capped", got)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	p := testRetryPolicy()
+	p.Jitter = 0.1
+	for i := 0; i < 100; i++ {
+		if got, _ := p.delay(1, errors.New("failed")); got < 100*time.Millisecond || got > 110*time.Millisecond {
+			t.Fatalf("delay with jitter %s, want between 100ms and 110ms", got)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&DispatchError{StatusCode: 503}, true},
+		{&DispatchError{StatusCode: 429, RetryAfter: time.Second}, true},
+		{&DispatchError{StatusCode: 500}, false},
+		{&DispatchError{StatusCode: 404}, false},
+		{timeoutError{}, true},
+		{refused, true},
+		{fmt.Errorf("post: %w", refused), true},
+		{nats.ErrTimeout, true},
+		{nats.ErrNoResponders, true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("x509: certificate signed by unknown authority"), false},
+	}
+	p := testRetryPolicy()
+	for _, tt := range tests {
+		if got := p.retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 0, 0},
+		{"7", 7 * time.Second, 7 * time.Second},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		if got := parseRetryAfter(resp); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+	// a date in the past is no delay
+	resp := &http.Response{Header: http.Header{"Retry-After": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}}
+	if got := parseRetryAfter(resp); got > 0 {
+		t.Errorf("parseRetryAfter of a past date = %s", got)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		policy   func(p *retryPolicy)
+		attempts int
+		err      bool
+	}{
+		{"success", nil, nil, 1, false},
+		{"success after retries", []error{&DispatchError{StatusCode: 503}, &DispatchError{StatusCode: 503}}, nil, 3, false},
+		{"not retryable", []error{&DispatchError{StatusCode: 400}}, nil, 1, true},
+		{"attempts used up", []error{&DispatchError{StatusCode: 503}, &DispatchError{StatusCode: 503}, &DispatchError{StatusCode: 503}}, func(p *retryPolicy) { p.Steps = 2 }, 2, true},
+		{"retry after longer than max delay", []error{&DispatchError{StatusCode: 429, RetryAfter: time.Minute}}, nil, 1, true},
+		{"max duration", []error{&DispatchError{StatusCode: 503}, &DispatchError{StatusCode: 503}}, func(p *retryPolicy) { p.Base, p.MaxDuration = 100*time.Millisecond, 50*time.Millisecond }, 1, true},
+	}
+	for _, tt := range tests {
+		p := testRetryPolicy()
+		p.Base = time.Millisecond
+		if tt.policy != nil {
+			tt.policy(p)
+		}
+		attempts := 0
+		err := p.do(context.Background(), func() error {
+			attempts++
+			if attempts <= len(tt.errs) {
+				return tt.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != tt.attempts || (err != nil) != tt.err {
+			t.Errorf("%s: %d attempts, error %v, want %d attempts, error %t", tt.name, attempts, err, tt.attempts, tt.err)
+		}
+	}
+}
+
+func TestRetryDoCanceled(t *testing.T) {
+	p := testRetryPolicy()
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := p.do(ctx, func() error {
+		attempts++
+		cancel()
+		return &DispatchError{StatusCode: 503}
+	})
+	if attempts != 1 || err == nil {
+		t.Errorf("%d attempts, error %v, want 1 attempt and an error", attempts, err)
+	}
+}
+
+// jsMsg returns an event as delivered by JetStream for the given delivery, published at published
+func jsMsg(delivered int, published time.Time) *nats.Msg {
+	return &nats.Msg{
+		Subject: "NETBOX.qa-de-1.device",
+		Reply:   fmt.Sprintf("$JS.ACK.NETBOX.test-device.%d.7.7.%d.0", delivered, published.UnixNano()),
+		Sub:     &nats.Subscription{},
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+		d    delivery
+		want bool
+	}{
+		{"retryable", jsMsg(1, time.Now()), delivery{attempts: 1, err: &DispatchError{StatusCode: 503}}, true},
+		{"not retryable", jsMsg(1, time.Now()), delivery{attempts: 1, err: &DispatchError{StatusCode: 400}}, false},
+		{"max deliveries", jsMsg(5, time.Now()), delivery{attempts: 5, err: &DispatchError{StatusCode: 503}}, false},
+		{"retry after longer than max delay", jsMsg(1, time.Now()), delivery{attempts: 1, err: &DispatchError{StatusCode: 429, RetryAfter: time.Minute}}, false},
+		{"max duration", jsMsg(2, time.Now().Add(-time.Hour)), delivery{attempts: 2, err: &DispatchError{StatusCode: 503}}, false},
+		{"not a JetStream event", &nats.Msg{Subject: "NETBOX.qa-de-1.device"}, delivery{attempts: 1, err: &DispatchError{StatusCode: 503}}, false},
+	}
+	for _, tt := range tests {
+		p := testRetryPolicy()
+		p.Mode = config.RetryRedelivery
+		p.MaxDuration = time.Minute
+		c := &Consumer{
+			name:                     "test",
+			retry:                    p,
+			distributionRedeliveries: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_redeliveries_total"}),
+		}
+		if got := c.redeliver(tt.msg, tt.d); got != tt.want {
+			t.Errorf("%s: redeliver = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
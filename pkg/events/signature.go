@@ -0,0 +1,45 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+)
+
+// signatureHeader is set by Netbox when a secret is configured for a webhook.
+// It holds the hex encoded HMAC-SHA512 of the request body.
+const signatureHeader = "X-Hook-Signature"
+
+// verifySignature checks the Netbox signature of body against every secret.
+// Accepting any of several secrets allows to rotate them without downtime.
+func verifySignature(body []byte, signature string, secrets [][]byte) bool {
+	sig, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	for _, secret := range secrets {
+		mac := hmac.New(sha512.New, secret)
+		mac.Write(body)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"event":"created","model":"device","data":{"id":1}}`)
+	secrets := [][]byte{[]byte("old"), []byte("new")}
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		secrets   [][]byte
+		want      bool
+	}{
+		{"first secret", body, sign(body, "old"), secrets, true},
+		{"second secret while rotating", body, sign(body, "new"), secrets, true},
+		{"upper case hex", body, strings.ToUpper(sign(body, "new")), secrets, true},
+		{"surrounding whitespace", body, " " + sign(body, "old") + "\n", secrets, true},
+		{"unknown secret", body, sign(body, "other"), secrets, false},
+		{"removed secret", body, sign(body, "old"), [][]byte{[]byte("new")}, false},
+		{"altered body", []byte(`{"event":"deleted","model":"device","data":{"id":1}}`), sign(body, "old"), secrets, false},
+		{"missing signature", body, "", secrets, false},
+		{"invalid hex", body, "not-hex", secrets, false},
+		{"truncated signature", body, sign(body, "old")[:64], secrets, false},
+		{"no secrets", body, sign(body, "old"), nil, false},
+	}
+	for _, tt := range tests {
+		if got := verifySignature(tt.body, tt.signature, tt.secrets); got != tt.want {
+			t.Errorf("%s: verifySignature = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestVerifySignatureKnown checks a signature computed with openssl dgst -sha512 -hmac secret
+func TestVerifySignatureKnown(t *testing.T) {
+	body := []byte(`{"event": "created"}`)
+	const signature = "4eac523738ee4bce83285a165a5e0224c93b9de017f1a7e5647fe158ea56a916e483a8974b37d3f682dfbdeae5cdcd3ea9817df18111462421c79a3dbffb237c"
+	if !verifySignature(body, signature, [][]byte{[]byte("secret")}) {
+		t.Error("signature not verified")
+	}
+}
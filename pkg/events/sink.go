@@ -0,0 +1,64 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// Sink delivers events to a recipient
+type Sink interface {
+	// Send delivers one event. Errors retryable by the retry policy of the distributor are retried.
+	Send(ctx context.Context, m Message) error
+	Close() error
+	// String describes the recipient for log messages
+	String() string
+}
+
+// Message is an event ready to be sent to the recipient
+type Message struct {
+	// Subject of the event in the NETBOX stream
+	Subject string
+	// Key identifies the Netbox object, events with the same key belong to the same object
+	Key         string
+	Data        []byte
+	ContentType string
+	Headers     map[string]string
+}
+
+// newSink creates the sink of the distributor, client is used by the sinks talking http
+func newSink(d config.Distributor, nc *nats.Conn, client *http.Client) (Sink, error) {
+	switch d.SinkType() {
+	case config.SinkHTTP:
+		return newHTTPSink(d.URL, client), nil
+	case config.SinkNATS:
+		return newNATSSink(nc, d.Sink.Subject), nil
+	case config.SinkJetStream:
+		return newJetStreamSink(nc, d.Sink.Subject)
+	case config.SinkKafka:
+		return newKafkaSink(d.Sink.URL, d.Sink.Topic, client), nil
+	case config.SinkFile:
+		return newFileSink(d.Sink.Path)
+	case config.SinkStdout:
+		return newStdoutSink(), nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", d.SinkType())
+}
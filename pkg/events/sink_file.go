@@ -0,0 +1,92 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileSink appends events as json lines to a file or stdout, it is meant for debugging
+type fileSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	f    *os.File
+	name string
+}
+
+type fileRecord struct {
+	Time        time.Time         `json:"time"`
+	Subject     string            `json:"subject"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Data is embedded as is if it is json, otherwise as string
+	Data json.RawMessage `json:"data"`
+}
+
+func newFileSink(path string) (s *fileSink, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	return &fileSink{w: f, f: f, name: "file://" + path}, nil
+}
+
+func newStdoutSink() *fileSink {
+	return &fileSink{w: os.Stdout, name: "stdout"}
+}
+
+func (s *fileSink) Send(ctx context.Context, m Message) (err error) {
+	data := json.RawMessage(m.Data)
+	if !json.Valid(m.Data) {
+		if data, err = json.Marshal(string(m.Data)); err != nil {
+			return
+		}
+	}
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(fileRecord{
+		Time:        time.Now().UTC(),
+		Subject:     m.Subject,
+		ContentType: m.ContentType,
+		Headers:     m.Headers,
+		Data:        data,
+	})
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(buf.Bytes())
+	return
+}
+
+func (s *fileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+func (s *fileSink) String() string {
+	return s.name
+}
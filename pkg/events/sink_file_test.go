@@ -0,0 +1,81 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	messages := []Message{
+		{Subject: "NETBOX.qa-de-1.device", ContentType: "application/json", Data: []byte(`{"id":42}`),
+			Headers: map[string]string{DistributorHdr: "test01"}},
+		{Subject: "NETBOX.qa-de-1.device", ContentType: "text/plain", Data: []byte("device <42> deleted")},
+	}
+	// the file is appended to, also after a restart
+	for _, m := range messages {
+		s, err := newFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Send(context.Background(), m); err != nil {
+			t.Fatalf("Send error: %s", err.Error())
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []fileRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not json: %s", scanner.Text(), err.Error())
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d lines, want 2", len(records))
+	}
+	if r := records[0]; r.Subject != messages[0].Subject || r.ContentType != "application/json" ||
+		r.Headers[DistributorHdr] != "test01" || string(r.Data) != `{"id":42}` || r.Time.IsZero() {
+		t.Errorf("first record %+v", r)
+	}
+	// data which is not json is embedded as string
+	var data string
+	if err := json.Unmarshal(records[1].Data, &data); err != nil || data != "device <42> deleted" {
+		t.Errorf("second record data %s is not the string of the message", records[1].Data)
+	}
+}
+
+func TestFileSinkInvalidPath(t *testing.T) {
+	if _, err := newFileSink(filepath.Join(t.TempDir(), "missing", "events.jsonl")); err == nil {
+		t.Error("newFileSink in a missing directory succeeded")
+	}
+}
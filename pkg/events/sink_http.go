@@ -0,0 +1,63 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// httpSink posts events to a url. The recipient has to respond with 200.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string, client *http.Client) *httpSink {
+	return &httpSink{url: url, client: client}
+}
+
+func (s *httpSink) Send(ctx context.Context, m Message) (err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewBuffer(m.Data))
+	if err != nil {
+		return
+	}
+	for k, v := range m.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", m.ContentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &DispatchError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp),
+		}
+	}
+	return
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+func (s *httpSink) String() string {
+	return s.url
+}
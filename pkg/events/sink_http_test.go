@@ -0,0 +1,133 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+func testHTTPClient(t *testing.T) *http.Client {
+	client, err := newHTTPClient("test", config.DefaultHTTPClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestHTTPSink(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := newHTTPSink(srv.URL+"/hook", testHTTPClient(t))
+	err := s.Send(context.Background(), Message{
+		Data:        []byte(`{"id":1}`),
+		ContentType: "application/json",
+		Headers:     map[string]string{DistributorHdr: "test01", EventIDHdr: "abc"},
+	})
+	if err != nil {
+		t.Fatalf("Send error: %s", err.Error())
+	}
+	if got.Method != "POST" || got.URL.Path != "/hook" {
+		t.Errorf("request %s %s, want POST /hook", got.Method, got.URL.Path)
+	}
+	if string(body) != `{"id":1}` {
+		t.Errorf("body %s", body)
+	}
+	for k, want := range map[string]string{"Content-Type": "application/json", DistributorHdr: "test01", EventIDHdr: "abc"} {
+		if v := got.Header.Get(k); v != want {
+			t.Errorf("header %s = %q, want %q", k, v, want)
+		}
+	}
+}
+
+func TestHTTPSinkStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{http.StatusCreated, "", 0},
+		{http.StatusInternalServerError, "", 0},
+		{http.StatusTooManyRequests, "7", 7 * time.Second},
+		{http.StatusServiceUnavailable, "soon", 0},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		err := newHTTPSink(srv.URL, testHTTPClient(t)).Send(context.Background(), Message{Data: []byte("{}")})
+		srv.Close()
+		// only 200 is a successful delivery
+		var d *DispatchError
+		if !errors.As(err, &d) {
+			t.Errorf("status %d: error %v, want a DispatchError", tt.status, err)
+			continue
+		}
+		if d.StatusCode != tt.status || d.RetryAfter != tt.want {
+			t.Errorf("status %d: got status %d, retry after %s, want %s", tt.status, d.StatusCode, d.RetryAfter, tt.want)
+		}
+	}
+}
+
+func TestHTTPSinkTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := newHTTPSink(srv.URL, testHTTPClient(t)).Send(ctx, Message{Data: []byte("{}")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want deadline exceeded", err)
+	}
+	if !newRetryPolicy(config.DefaultRetry).retryable(err) {
+		t.Error("timeout is not retried")
+	}
+}
+
+func TestHTTPSinkConnectionRefused(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	err := newHTTPSink(url, testHTTPClient(t)).Send(context.Background(), Message{Data: []byte("{}")})
+	if err == nil {
+		t.Fatal("Send to a closed server succeeded")
+	}
+	if !newRetryPolicy(config.DefaultRetry).retryable(err) {
+		t.Errorf("error %s is not retried", err.Error())
+	}
+}
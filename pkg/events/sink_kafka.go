@@ -0,0 +1,114 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const kafkaBinaryContentType = "application/vnd.kafka.binary.v2+json"
+
+// kafkaSink produces events to a Kafka topic via the Kafka REST proxy api (v2),
+// which is also offered by Kafka compatible systems like Redpanda.
+// The key of the record is the Netbox object, so all events of one object end up in the same partition.
+// The v2 api does not support record headers, the content type and headers of the message are not sent.
+type kafkaSink struct {
+	url    string
+	topic  string
+	client *http.Client
+}
+
+type kafkaRecord struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value"`
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode int    `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func newKafkaSink(proxyURL, topic string, client *http.Client) *kafkaSink {
+	return &kafkaSink{
+		url:    strings.TrimSuffix(proxyURL, "/") + "/topics/" + url.PathEscape(topic),
+		topic:  topic,
+		client: client,
+	}
+}
+
+func (s *kafkaSink) Send(ctx context.Context, m Message) (err error) {
+	r := kafkaRecord{Value: m.Data}
+	if m.Key != "" {
+		r.Key = []byte(m.Key)
+	}
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{r}})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", kafkaBinaryContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &DispatchError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp),
+		}
+	}
+	res := kafkaResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("kafka decode response: %s", err.Error())
+	}
+	for _, o := range res.Offsets {
+		if o.ErrorCode != 0 || o.Error != "" {
+			// the proxy reports broker errors per record, treat them as unavailable to retry
+			return &DispatchError{
+				StatusCode: http.StatusServiceUnavailable,
+				Err:        fmt.Errorf("kafka produce to %s: %s (%d)", s.topic, o.Error, o.ErrorCode),
+			}
+		}
+	}
+	return
+}
+
+func (s *kafkaSink) Close() error {
+	return nil
+}
+
+func (s *kafkaSink) String() string {
+	return "kafka://" + s.topic
+}
@@ -0,0 +1,103 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// kafkaProxy is a stand-in for the Kafka REST proxy, answering with response
+func kafkaProxy(t *testing.T, status int, response string, got *http.Request, records *kafkaRecords) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = *r
+		if err := json.NewDecoder(r.Body).Decode(records); err != nil {
+			t.Errorf("decode records: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+}
+
+func TestKafkaSink(t *testing.T) {
+	var got http.Request
+	var records kafkaRecords
+	srv := kafkaProxy(t, http.StatusOK, `{"offsets":[{"partition":0,"offset":12}]}`, &got, &records)
+	defer srv.Close()
+
+	s := newKafkaSink(srv.URL+"/", "netbox events", testHTTPClient(t))
+	err := s.Send(context.Background(), Message{Key: "device/42", Data: []byte(`{"id":42}`)})
+	if err != nil {
+		t.Fatalf("Send error: %s", err.Error())
+	}
+	if got.Method != "POST" || got.URL.EscapedPath() != "/topics/netbox%20events" {
+		t.Errorf("request %s %s, want POST /topics/netbox%%20events", got.Method, got.URL.EscapedPath())
+	}
+	if ct := got.Header.Get("Content-Type"); ct != kafkaBinaryContentType {
+		t.Errorf("content type %q, want %q", ct, kafkaBinaryContentType)
+	}
+	if len(records.Records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records.Records))
+	}
+	// the binary format sends key and value base64 encoded, decoded by json into []byte
+	if r := records.Records[0]; string(r.Key) != "device/42" || string(r.Value) != `{"id":42}` {
+		t.Errorf("record key %q value %q", r.Key, r.Value)
+	}
+}
+
+func TestKafkaSinkWithoutKey(t *testing.T) {
+	var got http.Request
+	var records kafkaRecords
+	srv := kafkaProxy(t, http.StatusOK, `{"offsets":[{"partition":0,"offset":1}]}`, &got, &records)
+	defer srv.Close()
+
+	if err := newKafkaSink(srv.URL, "netbox", testHTTPClient(t)).Send(context.Background(), Message{Data: []byte("{}")}); err != nil {
+		t.Fatalf("Send error: %s", err.Error())
+	}
+	if len(records.Records) != 1 || records.Records[0].Key != nil {
+		t.Errorf("records %+v, want one record without key", records.Records)
+	}
+}
+
+func TestKafkaSinkErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		want     int
+	}{
+		{"proxy error", http.StatusInternalServerError, `{"error_code":50001,"message":"broker down"}`, http.StatusInternalServerError},
+		{"unknown topic", http.StatusNotFound, `{"error_code":40401,"message":"topic not found"}`, http.StatusNotFound},
+		{"record error", http.StatusOK, `{"offsets":[{"partition":null,"offset":null,"error_code":2,"error":"leader not available"}]}`, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		var got http.Request
+		var records kafkaRecords
+		srv := kafkaProxy(t, tt.status, tt.response, &got, &records)
+		err := newKafkaSink(srv.URL, "netbox", testHTTPClient(t)).Send(context.Background(), Message{Data: []byte("{}")})
+		srv.Close()
+		var d *DispatchError
+		if !errors.As(err, &d) || d.StatusCode != tt.want {
+			t.Errorf("%s: error %v, want a DispatchError with status %d", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package events
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// header carrying the content type of events published to nats
+const contentTypeHdr = "Content-Type"
+
+func natsMsg(subject string, m Message) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = m.Data
+	for k, v := range m.Headers {
+		msg.Header.Set(k, v)
+	}
+	msg.Header.Set(contentTypeHdr, m.ContentType)
+	return msg
+}
+
+// natsSink publishes events to a core nats subject
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNATSSink(nc *nats.Conn, subject string) *natsSink {
+	return &natsSink{nc: nc, subject: subject}
+}
+
+func (s *natsSink) Send(ctx context.Context, m Message) (err error) {
+	if err = s.nc.PublishMsg(natsMsg(s.subject, m)); err != nil {
+		return
+	}
+	// make sure the server received it, publish only buffers the message
+	return s.nc.FlushWithContext(ctx)
+}
+
+func (s *natsSink) Close() error {
+	return nil
+}
+
+func (s *natsSink) String() string {
+	return "nats://" + s.subject
+}
+
+// jetStreamSink publishes events to a subject of a JetStream stream and waits for the ack of the stream
+type jetStreamSink struct {
+	js      nats.JetStreamContext
+	subject string
+}
+
+func newJetStreamSink(nc *nats.Conn, subject string) (s *jetStreamSink, err error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return
+	}
+	return &jetStreamSink{js: js, subject: subject}, nil
+}
+
+func (s *jetStreamSink) Send(ctx context.Context, m Message) (err error) {
+	_, err = s.js.PublishMsg(natsMsg(s.subject, m), nats.Context(ctx))
+	return
+}
+
+func (s *jetStreamSink) Close() error {
+	return nil
+}
+
+func (s *jetStreamSink) String() string {
+	return "jetstream://" + s.subject
+}
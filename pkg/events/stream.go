@@ -0,0 +1,66 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// streamConfig returns the config of the NETBOX stream
+func streamConfig(cfg config.StreamConfig) *nats.StreamConfig {
+	sc := &nats.StreamConfig{
+		Name:              streamName,
+		Subjects:          []string{streamSubjects},
+		MaxBytes:          cfg.MaxBytes,
+		MaxMsgsPerSubject: cfg.MaxMsgsPerSubject,
+		Replicas:          cfg.Replicas,
+		Storage:           nats.FileStorage,
+		Discard:           nats.DiscardOld,
+		Duplicates:        cfg.DuplicateWindow,
+	}
+	if cfg.MaxAge != nil {
+		sc.MaxAge = *cfg.MaxAge
+	}
+	if cfg.Storage == config.StorageMemory {
+		sc.Storage = nats.MemoryStorage
+	}
+	if cfg.Discard == config.DiscardNew {
+		sc.Discard = nats.DiscardNew
+	}
+	return sc
+}
+
+// streamDiff lists the settings which differ between the current and the wanted stream config
+func streamDiff(current, wanted *nats.StreamConfig) (diff []string) {
+	add := func(name string, c, w interface{}) {
+		if fmt.Sprint(c) != fmt.Sprint(w) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", name, c, w))
+		}
+	}
+	add("subjects", current.Subjects, wanted.Subjects)
+	add("max_age", current.MaxAge, wanted.MaxAge)
+	add("max_bytes", current.MaxBytes, wanted.MaxBytes)
+	add("max_msgs_per_subject", current.MaxMsgsPerSubject, wanted.MaxMsgsPerSubject)
+	add("replicas", current.Replicas, wanted.Replicas)
+	add("storage", current.Storage, wanted.Storage)
+	add("discard", current.Discard, wanted.Discard)
+	add("duplicate_window", current.Duplicates, wanted.Duplicates)
+	return
+}
@@ -0,0 +1,242 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+	"github.com/siddontang/go/log"
+)
+
+// tokenRefreshMargin refreshes tokens before they expire, so they do not expire in flight
+const tokenRefreshMargin = 30 * time.Second
+
+// tokenTimeout limits fetching a token
+const tokenTimeout = 10 * time.Second
+
+// tokenSource fetches a token and its expiry
+type tokenSource func(ctx context.Context, client *http.Client) (token string, expiry time.Time, err error)
+
+// tokenProvider caches the token of a tokenSource until it expires
+type tokenProvider struct {
+	source tokenSource
+	client *http.Client
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+// newTokenProvider fetches tokens with the http settings of the recipient client, see tokenTransport
+func newTokenProvider(source tokenSource, client *http.Client) *tokenProvider {
+	return &tokenProvider{source: source, client: &http.Client{Transport: tokenTransport(client), Timeout: tokenTimeout}}
+}
+
+// token returns the cached token or fetches a new one
+func (p *tokenProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != "" && time.Until(p.expiry) > tokenRefreshMargin {
+		return p.cached, nil
+	}
+	token, expiry, err := p.source(ctx, p.client)
+	if err != nil {
+		// the recipient can not be reached without a token, treat it as unavailable to retry
+		return "", &DispatchError{
+			StatusCode: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("fetch token: %s", err.Error()),
+		}
+	}
+	log.Debugf("fetched token valid until %s", expiry)
+	p.cached, p.expiry = token, expiry
+	return token, nil
+}
+
+// invalidate drops the token, if it is still the cached one, e.g. after the recipient rejected it
+func (p *tokenProvider) invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached == token {
+		p.cached = ""
+	}
+}
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// oauth2ClientCredentials fetches a token with the client credentials grant, RFC 6749 section 4.4
+func oauth2ClientCredentials(a *config.OAuth2Auth) (tokenSource, error) {
+	secret, err := a.ClientSecret.Value()
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, client *http.Client) (token string, expiry time.Time, err error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if len(a.Scopes) > 0 {
+			form.Set("scope", strings.Join(a.Scopes, " "))
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", a.TokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(secret))
+		resp, err := client.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", expiry, tokenError(resp)
+		}
+		t := oauth2Token{}
+		if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return "", expiry, fmt.Errorf("decode oauth2 token: %s", err.Error())
+		}
+		if t.AccessToken == "" {
+			return "", expiry, fmt.Errorf("oauth2 token response has no access_token")
+		}
+		// tokens without expiry are refreshed after an hour or when they are rejected
+		expiry = time.Now().Add(time.Hour)
+		if t.ExpiresIn > 0 {
+			expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+		}
+		return t.AccessToken, expiry, nil
+	}, nil
+}
+
+// keystoneAuthRequest is the body of POST /v3/auth/tokens
+type keystoneAuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods               []string                       `json:"methods"`
+			ApplicationCredential *keystoneApplicationCredential `json:"application_credential,omitempty"`
+			Password              *keystonePassword              `json:"password,omitempty"`
+		} `json:"identity"`
+		Scope *keystoneScope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type keystoneApplicationCredential struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type keystonePassword struct {
+	User struct {
+		Name     string       `json:"name"`
+		Domain   keystoneName `json:"domain"`
+		Password string       `json:"password"`
+	} `json:"user"`
+}
+
+type keystoneName struct {
+	Name string `json:"name"`
+}
+
+type keystoneScope struct {
+	Project struct {
+		ID     string        `json:"id,omitempty"`
+		Name   string        `json:"name,omitempty"`
+		Domain *keystoneName `json:"domain,omitempty"`
+	} `json:"project"`
+}
+
+type keystoneToken struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"token"`
+}
+
+// keystoneTokenSource fetches a Keystone v3 token with an application credential or a project scoped password
+func keystoneTokenSource(a *config.KeystoneAuth) (tokenSource, error) {
+	body := keystoneAuthRequest{}
+	id := &body.Auth.Identity
+	if a.ApplicationCredentialID != "" {
+		secret, err := a.ApplicationCredentialSecret.Value()
+		if err != nil {
+			return nil, err
+		}
+		id.Methods = []string{"application_credential"}
+		id.ApplicationCredential = &keystoneApplicationCredential{ID: a.ApplicationCredentialID, Secret: secret}
+	} else {
+		password, err := a.Password.Value()
+		if err != nil {
+			return nil, err
+		}
+		id.Methods = []string{"password"}
+		id.Password = &keystonePassword{}
+		id.Password.User.Name = a.Username
+		id.Password.User.Domain.Name = a.UserDomainName
+		id.Password.User.Password = password
+		body.Auth.Scope = &keystoneScope{}
+		if a.ProjectID != "" {
+			body.Auth.Scope.Project.ID = a.ProjectID
+		} else {
+			body.Auth.Scope.Project.Name = a.ProjectName
+			body.Auth.Scope.Project.Domain = &keystoneName{Name: a.ProjectDomainName}
+		}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	tokensURL := strings.TrimSuffix(a.AuthURL, "/") + "/auth/tokens"
+	return func(ctx context.Context, client *http.Client) (token string, expiry time.Time, err error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", tokensURL, bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return "", expiry, tokenError(resp)
+		}
+		t := keystoneToken{}
+		if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return "", expiry, fmt.Errorf("decode keystone token: %s", err.Error())
+		}
+		token = resp.Header.Get("X-Subject-Token")
+		if token == "" {
+			return "", expiry, fmt.Errorf("keystone response has no X-Subject-Token")
+		}
+		return token, t.Token.ExpiresAt, nil
+	}, nil
+}
+
+func tokenError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected http status code %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+}
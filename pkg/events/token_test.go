@@ -0,0 +1,248 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/netbox-webhook-distributor/pkg/config"
+)
+
+// tokenStandIn issues oauth2 and keystone tokens and serves a recipient accepting only the latest token
+type tokenStandIn struct {
+	*httptest.Server
+	expiresIn int
+
+	mu        sync.Mutex
+	issued    int
+	valid     string
+	requests  []*http.Request
+	forms     []string
+	delivered []string
+}
+
+func newTokenStandIn(expiresIn int) *tokenStandIn {
+	s := &tokenStandIn{expiresIn: expiresIn}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.issued++
+		s.valid = fmt.Sprintf("token%d", s.issued)
+		s.requests = append(s.requests, r)
+		s.forms = append(s.forms, r.PostForm.Encode())
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": s.valid, "expires_in": s.expiresIn, "token_type": "bearer"})
+	})
+	mux.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.issued++
+		s.valid = fmt.Sprintf("keystone%d", s.issued)
+		w.Header().Set("X-Subject-Token", s.valid)
+		w.WriteHeader(http.StatusCreated)
+		expiresAt := time.Now().Add(time.Duration(s.expiresIn) * time.Second).UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, `{"token":{"expires_at":"%s"}}`, expiresAt)
+	})
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		token := r.Header.Get("X-Auth-Token")
+		if a := r.Header.Get("Authorization"); a != "" {
+			token = a[len("Bearer "):]
+		}
+		s.delivered = append(s.delivered, token)
+		if token != s.valid {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// revoke invalidates the current token before it expires
+func (s *tokenStandIn) revoke() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.valid = "revoked"
+}
+
+func (s *tokenStandIn) counts() (issued, delivered int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued, len(s.delivered)
+}
+
+// tokenConsumer is a consumer delivering to the stand-in with the given auth
+func tokenConsumer(t *testing.T, s *tokenStandIn, auth *config.Auth) *Consumer {
+	client := testHTTPClient(t)
+	o, err := newOutboundAuth(auth, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Consumer{
+		name:              "test",
+		auth:              o,
+		sink:              newHTTPSink(s.URL+"/hook", client),
+		dispatchTimeout:   time.Second,
+		dispatchDuration:  prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_dispatch_duration_seconds"}),
+		dispatchResponses: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_responses_total"}, []string{"code"}),
+	}
+}
+
+func oauth2Auth(t *testing.T, s *tokenStandIn) *config.Auth {
+	t.Setenv("TEST_CLIENT_SECRET", "s3cret")
+	return &config.Auth{OAuth2: &config.OAuth2Auth{
+		TokenURL:     s.URL + "/oauth/token",
+		ClientID:     "distributor",
+		ClientSecret: config.SecretRef{Env: "TEST_CLIENT_SECRET"},
+		Scopes:       []string{"events", "write"},
+	}}
+}
+
+func dispatch(c *Consumer) error {
+	return c.dispatch(context.Background(), Message{Data: []byte("{}"), Headers: map[string]string{}}, 1)
+}
+
+func TestOAuth2TokenCached(t *testing.T) {
+	s := newTokenStandIn(3600)
+	defer s.Close()
+	c := tokenConsumer(t, s, oauth2Auth(t, s))
+
+	for i := 0; i < 3; i++ {
+		if err := dispatch(c); err != nil {
+			t.Fatalf("dispatch %d error: %s", i, err.Error())
+		}
+	}
+	if issued, delivered := s.counts(); issued != 1 || delivered != 3 {
+		t.Errorf("issued %d tokens for %d deliveries, want 1 for 3", issued, delivered)
+	}
+	if user, password, _ := s.requests[0].BasicAuth(); user != "distributor" || password != "s3cret" {
+		t.Errorf("client credentials %s:%s", user, password)
+	}
+	if want := "grant_type=client_credentials&scope=events+write"; s.forms[0] != want {
+		t.Errorf("token request %s, want %s", s.forms[0], want)
+	}
+}
+
+func TestOAuth2TokenRefreshedBeforeExpiry(t *testing.T) {
+	// tokens expiring within the refresh margin are not used
+	s := newTokenStandIn(int(tokenRefreshMargin/time.Second) - 5)
+	defer s.Close()
+	c := tokenConsumer(t, s, oauth2Auth(t, s))
+
+	for i := 0; i < 2; i++ {
+		if err := dispatch(c); err != nil {
+			t.Fatalf("dispatch %d error: %s", i, err.Error())
+		}
+	}
+	if issued, _ := s.counts(); issued != 2 {
+		t.Errorf("issued %d tokens, want a new token for every delivery", issued)
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	s := newTokenStandIn(3600)
+	defer s.Close()
+	c := tokenConsumer(t, s, oauth2Auth(t, s))
+
+	if err := dispatch(c); err != nil {
+		t.Fatalf("dispatch error: %s", err.Error())
+	}
+	s.revoke()
+	// the revoked token is rejected, a new one is fetched and the event sent once more
+	if err := dispatch(c); err != nil {
+		t.Fatalf("dispatch with revoked token error: %s", err.Error())
+	}
+	if issued, delivered := s.counts(); issued != 2 || delivered != 3 {
+		t.Errorf("issued %d tokens for %d deliveries, want 2 for 3", issued, delivered)
+	}
+	if want := []string{"token1", "token1", "token2"}; fmt.Sprint(s.delivered) != fmt.Sprint(want) {
+		t.Errorf("delivered with %v, want %v", s.delivered, want)
+	}
+}
+
+func TestTokenRejectedOnlyRetriedOnce(t *testing.T) {
+	s := newTokenStandIn(3600)
+	defer s.Close()
+	c := tokenConsumer(t, s, oauth2Auth(t, s))
+	c.sink = newHTTPSink(s.URL+"/unauthorized", testHTTPClient(t))
+	s.Config.Handler.(*http.ServeMux).HandleFunc("/unauthorized", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.delivered = append(s.delivered, r.Header.Get("Authorization"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	err := dispatch(c)
+	var d *DispatchError
+	if !errors.As(err, &d) || d.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("error %v, want 401", err)
+	}
+	if issued, delivered := s.counts(); issued != 2 || delivered != 2 {
+		t.Errorf("issued %d tokens for %d deliveries, want 2 for 2", issued, delivered)
+	}
+}
+
+func TestTokenEndpointUnavailable(t *testing.T) {
+	s := newTokenStandIn(3600)
+	auth := oauth2Auth(t, s)
+	c := tokenConsumer(t, s, auth)
+	s.Close()
+
+	err := dispatch(c)
+	var d *DispatchError
+	if !errors.As(err, &d) || d.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("error %v, want 503", err)
+	}
+	if !newRetryPolicy(config.DefaultRetry).retryable(err) {
+		t.Error("failing to fetch a token is not retried")
+	}
+}
+
+func TestKeystoneToken(t *testing.T) {
+	s := newTokenStandIn(3600)
+	defer s.Close()
+	t.Setenv("TEST_APP_CRED_SECRET", "s3cret")
+	c := tokenConsumer(t, s, &config.Auth{Keystone: &config.KeystoneAuth{
+		AuthURL:                     s.URL + "/v3/",
+		ApplicationCredentialID:     "0123abcd",
+		ApplicationCredentialSecret: &config.SecretRef{Env: "TEST_APP_CRED_SECRET"},
+	}})
+
+	for i := 0; i < 2; i++ {
+		if err := dispatch(c); err != nil {
+			t.Fatalf("dispatch %d error: %s", i, err.Error())
+		}
+	}
+	s.revoke()
+	if err := dispatch(c); err != nil {
+		t.Fatalf("dispatch with revoked token error: %s", err.Error())
+	}
+	if want := []string{"keystone1", "keystone1", "keystone1", "keystone2"}; fmt.Sprint(s.delivered) != fmt.Sprint(want) {
+		t.Errorf("delivered with %v, want %v", s.delivered, want)
+	}
+}
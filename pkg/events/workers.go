@@ -0,0 +1,100 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// inProgressInterval is the interval the ack wait of fetched events waiting for their worker is reset in
+const inProgressInterval = 10 * time.Second
+
+// processBatch partitions the events by the id of their Netbox object and delivers the partitions concurrently.
+// Events of the same object end up in the same partition and are delivered in the order they were fetched.
+// An event nak'ed in redelivery mode does not stop its partition, the later events of its object are delivered first.
+func (c *Consumer) processBatch(msgs []*nats.Msg, object string, state *subscriptionState) {
+	partitions := make([][]*nats.Msg, c.concurrency.Workers)
+	for _, msg := range msgs {
+		i := partition(msg, len(partitions))
+		partitions[i] = append(partitions[i], msg)
+	}
+	done := make([]int32, len(msgs))
+	finished := make(chan struct{})
+	var wg sync.WaitGroup
+	offset := 0
+	for _, p := range partitions {
+		if len(p) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p []*nats.Msg, offset int) {
+			defer wg.Done()
+			c.busyWorkers.Inc()
+			defer c.busyWorkers.Dec()
+			for i, msg := range p {
+				c.process(msg, object, state)
+				atomic.StoreInt32(&done[offset+i], 1)
+			}
+		}(p, offset)
+		offset += len(p)
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	// keep the events waiting behind a slow delivery from being redelivered
+	waiting := make([]*nats.Msg, 0, len(msgs))
+	for _, p := range partitions {
+		waiting = append(waiting, p...)
+	}
+	ticker := time.NewTicker(inProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ticker.C:
+			for i, msg := range waiting {
+				if atomic.LoadInt32(&done[i]) == 0 {
+					msg.InProgress()
+				}
+			}
+		}
+	}
+}
+
+// partition returns the partition of the event, derived from the id of its Netbox object
+func partition(msg *nats.Msg, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	wb := WebhookBody{}
+	if err := json.Unmarshal(msg.Data, &wb); err != nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(wb.Data.ID)))
+	return int(h.Sum32() % uint32(n))
+}
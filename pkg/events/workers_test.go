@@ -0,0 +1,70 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func objectMsg(id int, event string) *nats.Msg {
+	return &nats.Msg{Data: []byte(fmt.Sprintf(`{"event":%q,"model":"device","data":{"id":%d}}`, event, id))}
+}
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+		n    int
+		want int
+	}{
+		{"single worker", objectMsg(42, "updated"), 1, 0},
+		{"no workers", objectMsg(42, "updated"), 0, 0},
+		{"invalid json", &nats.Msg{Data: []byte(`{`)}, 4, 0},
+		{"without id", &nats.Msg{Data: []byte(`{"model":"device","data":{}}`)}, 4, partition(objectMsg(0, "updated"), 4)},
+		// fnv-32a of "42" modulo 4
+		{"known id", objectMsg(42, "updated"), 4, 3},
+	}
+	for _, tt := range tests {
+		if got := partition(tt.msg, tt.n); got != tt.want {
+			t.Errorf("%s: partition = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionKeepsObjectsTogether(t *testing.T) {
+	const workers = 4
+	used := make(map[int]bool)
+	for id := 1; id <= 100; id++ {
+		p := partition(objectMsg(id, "created"), workers)
+		if p < 0 || p >= workers {
+			t.Fatalf("partition %d of object %d out of range", p, id)
+		}
+		// all events of an object end up in the same partition, so they are delivered in order
+		for _, event := range []string{"updated", "deleted"} {
+			if got := partition(objectMsg(id, event), workers); got != p {
+				t.Errorf("%s event of object %d in partition %d, created event in %d", event, id, got, p)
+			}
+		}
+		used[p] = true
+	}
+	if len(used) != workers {
+		t.Errorf("100 objects spread over %d of %d partitions", len(used), workers)
+	}
+}
@@ -0,0 +1,177 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package filter implements the expressions used to select the Netbox events a distributor receives.
+//
+// An expression is evaluated against the full webhook json. Fields are addressed by their
+// dotted path, e.g. data.device_role.slug, list elements by their index, e.g. data.tags.0.slug.
+//
+//	data.device_role.slug == "cp"          equality, also !=
+//	data.name =~ "^node\\d+"               regular expression match, also !~
+//	data.site.slug in ["qa-de-1a", "qa-de-1b"]
+//	changed(status)                        snapshots.prechange.status != snapshots.postchange.status
+//	!(a == 1) && (b == 2 || c == 3)        boolean composition
+//
+// Values are strings ("..." or '...'), numbers, true, false and null. A missing field equals null.
+// Strings are unquoted like Go strings, so backslashes in regular expressions have to be doubled.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+// Filter is a parsed filter expression
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse parses a filter expression
+func Parse(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %s", expr, err.Error())
+	}
+	p := parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tEOF {
+		err = fmt.Errorf("unexpected %s at position %d", p.peek(), p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %s", expr, err.Error())
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match evaluates the filter against a decoded webhook
+func (f *Filter) Match(event map[string]interface{}) bool {
+	return f.root.eval(event)
+}
+
+// MatchJSON evaluates the filter against the webhook json
+func (f *Filter) MatchJSON(data []byte) (bool, error) {
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return false, err
+	}
+	return f.Match(event), nil
+}
+
+type node interface {
+	eval(event map[string]interface{}) bool
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(e map[string]interface{}) bool { return n.left.eval(e) || n.right.eval(e) }
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(e map[string]interface{}) bool { return n.left.eval(e) && n.right.eval(e) }
+
+type notNode struct{ n node }
+
+func (n notNode) eval(e map[string]interface{}) bool { return !n.n.eval(e) }
+
+type eqNode struct {
+	path  []string
+	value interface{}
+}
+
+func (n eqNode) eval(e map[string]interface{}) bool { return equal(lookup(e, n.path), n.value) }
+
+type inNode struct {
+	path []string
+	list []interface{}
+}
+
+func (n inNode) eval(e map[string]interface{}) bool {
+	v := lookup(e, n.path)
+	for _, l := range n.list {
+		if equal(v, l) {
+			return true
+		}
+	}
+	return false
+}
+
+type matchNode struct {
+	path []string
+	rx   *regexp.Regexp
+}
+
+func (n matchNode) eval(e map[string]interface{}) bool {
+	switch v := lookup(e, n.path).(type) {
+	case string:
+		return n.rx.MatchString(v)
+	case float64:
+		return n.rx.MatchString(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		return n.rx.MatchString(strconv.FormatBool(v))
+	}
+	return false
+}
+
+// changedNode compares a field of the prechange and postchange snapshots
+type changedNode struct {
+	path []string
+}
+
+func (n changedNode) eval(e map[string]interface{}) bool {
+	pre := lookup(e, append([]string{"snapshots", "prechange"}, n.path...))
+	post := lookup(e, append([]string{"snapshots", "postchange"}, n.path...))
+	return !reflect.DeepEqual(pre, post)
+}
+
+// Lookup returns the value at the dotted path in the decoded json, or nil if it does not exist
+func Lookup(v interface{}, path string) interface{} {
+	return lookup(v, splitPath(path))
+}
+
+// lookup returns the value at path, or nil if it does not exist
+func lookup(v interface{}, path []string) interface{} {
+	for _, p := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[p]
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return a == b
+}
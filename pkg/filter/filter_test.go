@@ -0,0 +1,206 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+const event = `{
+	"event": "updated",
+	"model": "device",
+	"data": {
+		"id": 42,
+		"name": "node001-bb091",
+		"primary": true,
+		"comment": "it's \"quoted\"",
+		"device_role": {"slug": "cp"},
+		"site": {"slug": "qa-de-1a"},
+		"tags": [{"slug": "a"}, {"slug": "b"}],
+		"tenant": null
+	},
+	"snapshots": {
+		"prechange": {"status": "planned", "name": "node001-bb091", "custom_fields": {"x": 1}},
+		"postchange": {"status": "active", "name": "node001-bb091", "custom_fields": {"x": 2}}
+	}
+}`
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// equality
+		{`data.device_role.slug == "cp"`, true},
+		{`data.device_role.slug != "cp"`, false},
+		{`data.id == 42`, true},
+		{`data.id == 42.0`, true},
+		{`data.id == "42"`, false},
+		{`data.primary == true`, true},
+		{`data.primary == false`, false},
+		{`data.tenant == null`, true},
+		{`data.missing == null`, true},
+		{`data.missing.deeper == null`, true},
+		{`data.tags.1.slug == "b"`, true},
+		{`data.tags.2.slug == null`, true},
+		{`data.site == "qa-de-1a"`, false},
+		// quoting and escapes
+		{`data.site.slug == 'qa-de-1a'`, true},
+		{`data.comment == "it's \"quoted\""`, true},
+		{`data.comment == 'it\'s "quoted"'`, true},
+		// in
+		{`data.site.slug in ["qa-de-1b", "qa-de-1a"]`, true},
+		{`data.site.slug in ["qa-de-1b"]`, false},
+		{`data.id in [1, 42]`, true},
+		{`data.tenant in [null]`, true},
+		// regular expressions
+		{`data.name =~ "^node\\d+-bb\\d+$"`, true},
+		{`data.name =~ "^bb"`, false},
+		{`data.name !~ "^bb"`, true},
+		{`data.id =~ "^4"`, true},
+		{`data.primary =~ "true"`, true},
+		{`data.missing =~ ".*"`, false},
+		// changed
+		{`changed(status)`, true},
+		{`changed(name)`, false},
+		{`changed(custom_fields.x)`, true},
+		{`changed(missing)`, false},
+		{`!changed(name)`, true},
+		// precedence, && binds stronger than ||
+		{`data.id == 1 && data.id == 2 || data.id == 42`, true},
+		{`data.id == 42 || data.id == 1 && data.id == 2`, true},
+		{`(data.id == 42 || data.id == 1) && data.id == 2`, false},
+		{`!data.id == 42 || data.primary == true`, true},
+		{`!(data.id == 42 || data.primary == false)`, false},
+		{`!!(data.id == 42)`, true},
+		{`data.id == 42 && (data.device_role.slug == "cp" && changed(status))`, true},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) error: %s", tt.expr, err.Error())
+			continue
+		}
+		got, err := f.MatchJSON([]byte(event))
+		if err != nil {
+			t.Fatalf("MatchJSON error: %s", err.Error())
+		}
+		if got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestDocExamples parses the examples of the package documentation
+func TestDocExamples(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`data.device_role.slug == "cp"`, true},
+		{`data.name =~ "^node\\d+"`, true},
+		{`data.site.slug in ["qa-de-1a", "qa-de-1b"]`, true},
+		{`changed(status)`, true},
+		{`!(data.id == 1) && (data.primary == true || data.tenant == 3)`, true},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) error: %s", tt.expr, err.Error())
+			continue
+		}
+		got, err := f.MatchJSON([]byte(event))
+		if err != nil {
+			t.Fatalf("MatchJSON error: %s", err.Error())
+		}
+		if got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, `expected field or "(" at position 0, got end of expression`},
+		{`data.id`, `expected operator (==, !=, =~, !~, in) at position 7, got end of expression`},
+		{`data.id > 1`, `unexpected character '>' at position 8`},
+		{`data.id == `, `expected string, number, true, false or null at position 11, got end of expression`},
+		{`data.id == foo`, `expected string, number, true, false or null at position 11, got "foo"`},
+		{`data.id == 1.2.3`, `invalid number "1.2.3" at position 11`},
+		{`data.name == "unterminated`, `unterminated string at position 13`},
+		{`data.name == "\q"`, `invalid string at position 13`},
+		{`data.name =~ "^node\d+"`, `invalid string at position 13`},
+		{`data.name =~ 1`, `expected regular expression string at position 13, got "1"`},
+		{`data.name =~ "("`, `invalid regular expression at position 13`},
+		{`data.id in 1`, `expected "[" at position 11, got "1"`},
+		{`data.id in [1 2]`, `expected "," or "]" at position 14, got "2"`},
+		{`data.id in []`, `expected string, number, true, false or null at position 12, got "]"`},
+		{`(data.id == 1`, `expected ")" at position 13, got end of expression`},
+		{`data.id == 1)`, `unexpected ")" at position 12`},
+		{`data.id == 1 &&`, `expected field or "(" at position 15, got end of expression`},
+		{`changed(status`, `expected ")" at position 14, got end of expression`},
+		{`changed("status")`, `expected field at position 8, got "status"`},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Parse(%s) succeeded, want error %q", tt.expr, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%s) error %q, want %q", tt.expr, err.Error(), tt.err)
+		}
+	}
+}
+
+func TestMatchJSONInvalid(t *testing.T) {
+	f, err := Parse(`data.id == 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.MatchJSON([]byte(`{`)); err == nil {
+		t.Error("MatchJSON of invalid json succeeded")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	v := map[string]interface{}{
+		"data": map[string]interface{}{
+			"tags": []interface{}{map[string]interface{}{"slug": "a"}},
+		},
+	}
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"data.tags.0.slug", "a"},
+		{"data.tags.1.slug", nil},
+		{"data.tags.-1", nil},
+		{"data.tags.x", nil},
+		{"data.tags.0.slug.deeper", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		if got := Lookup(v, tt.path); got != tt.want {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tIdent
+	tString
+	tNumber
+	tOp
+	tLParen
+	tRParen
+	tLBracket
+	tRBracket
+	tComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var operators = []string{"&&", "||", "==", "!=", "=~", "!~", "!"}
+
+func lex(src string) (tokens []token, err error) {
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tRParen, ")", i})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{tLBracket, "[", i})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{tRBracket, "]", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tComma, ",", i})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(src) && rune(src[j]) != c; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			s, err := unquote(src[i+1:j], c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %s", i, err.Error())
+			}
+			tokens = append(tokens, token{tString, s, i})
+			i = j + 1
+		case c == '-' || unicode.IsDigit(c):
+			j := i + 1
+			for ; j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.'); j++ {
+			}
+			tokens = append(tokens, token{tNumber, src[i:j], i})
+			i = j
+		case isIdent(c):
+			j := i + 1
+			for ; j < len(src) && (isIdent(rune(src[j])) || src[j] == '.'); j++ {
+			}
+			tokens = append(tokens, token{tIdent, src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{tOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tEOF, "", len(src)}), nil
+}
+
+func isIdent(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func unquote(s string, quote rune) (string, error) {
+	if quote == '\'' {
+		s = strings.ReplaceAll(s, `\'`, `'`)
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return strconv.Unquote(`"` + s + `"`)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at position %d, got %s", what, t.pos, t)
+	}
+	return t, nil
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tOp && t.text == op
+}
+
+// or := and ("||" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | primary
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := "(" or ")" | "changed" "(" path ")" | path op value | path "in" list
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case tIdent:
+	default:
+		return nil, fmt.Errorf("expected field or \"(\" at position %d, got %s", t.pos, t)
+	}
+
+	if t.text == "changed" && p.peek().kind == tLParen {
+		p.next()
+		f, err := p.expect(tIdent, "field")
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return changedNode{path: splitPath(f.text)}, nil
+	}
+
+	path := splitPath(t.text)
+	op := p.next()
+	switch {
+	case op.kind == tIdent && op.text == "in":
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{path, list}, nil
+	case op.kind == tOp && (op.text == "==" || op.text == "!="):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		var n node = eqNode{path, v}
+		if op.text == "!=" {
+			n = notNode{n}
+		}
+		return n, nil
+	case op.kind == tOp && (op.text == "=~" || op.text == "!~"):
+		s, err := p.expect(tString, "regular expression string")
+		if err != nil {
+			return nil, err
+		}
+		rx, err := regexp.Compile(s.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %s", s.pos, err.Error())
+		}
+		var n node = matchNode{path, rx}
+		if op.text == "!~" {
+			n = notNode{n}
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("expected operator (==, !=, =~, !~, in) at position %d, got %s", op.pos, op)
+}
+
+// list := "[" value ("," value)* "]"
+func (p *parser) parseList() (list []interface{}, err error) {
+	if _, err = p.expect(tLBracket, `"["`); err != nil {
+		return
+	}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		t := p.next()
+		if t.kind == tRBracket {
+			return list, nil
+		}
+		if t.kind != tComma {
+			return nil, fmt.Errorf(`expected "," or "]" at position %d, got %s`, t.pos, t)
+		}
+	}
+}
+
+// value := string | number | true | false | null
+func (p *parser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tString:
+		return t.text, nil
+	case tNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return f, nil
+	case tIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected string, number, true, false or null at position %d, got %s", t.pos, t)
+}
+
+func splitPath(s string) []string {
+	return strings.Split(s, ".")
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tlsutil loads CA bundles and certificates, which are reloaded when their files change.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go/log"
+)
+
+// reloadInterval is the minimum time between checks of the certificate files
+const reloadInterval = 10 * time.Second
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version like 1.2, an empty version is 0, the default of crypto/tls
+func ParseVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := versions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version %q, expected 1.0, 1.1, 1.2 or 1.3", v)
+	}
+	return version, nil
+}
+
+// LoadCAPool reads a PEM encoded CA bundle
+func LoadCAPool(file string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := AppendCAFile(pool, file); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// AppendCAFile adds the certificates of a PEM encoded CA bundle to pool
+func AppendCAFile(pool *x509.CertPool, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read ca file: %s", err.Error())
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("ca file %s contains no PEM certificates", file)
+	}
+	return nil
+}
+
+// CertReloader serves a certificate and reloads it once its files changed,
+// e.g. when cert-manager renewed a mounted secret.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the certificate and key
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the certificate for servers, see tls.Config
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// GetClientCertificate returns the certificate for clients, see tls.Config
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+func (r *CertReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < reloadInterval {
+		return r.cert
+	}
+	r.checked = time.Now()
+	if r.lastModified().After(r.modTime) {
+		if err := r.loadLocked(); err != nil {
+			log.Errorf("reload certificate %s, keeping the current one: %s", r.certFile, err.Error())
+		} else {
+			log.Infof("reloaded certificate %s", r.certFile)
+		}
+	}
+	return r.cert
+}
+
+func (r *CertReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	return r.loadLocked()
+}
+
+func (r *CertReloader) loadLocked() error {
+	modTime := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %s", err.Error())
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and key
+func (r *CertReloader) lastModified() (t time.Time) {
+	for _, f := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
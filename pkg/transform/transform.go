@@ -0,0 +1,110 @@
+/**
+ * Copyright 2021 SAP SE
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transform renders Netbox events with a text/template before they are distributed.
+//
+// The template is executed with the decoded webhook json, e.g. {{ .data.name }} or {{ .snapshots.prechange.status }}.
+// Missing fields are rendered as "<no value>", use default to render something else.
+// Next to the text/template builtins these functions are available:
+//
+//	json      encodes a value as json, e.g. {{ json .data.tags }}
+//	get       returns the value at a dotted path or nil, e.g. {{ get . "data.site.slug" }}
+//	default   returns the fallback if the value is empty, e.g. {{ default "none" .data.comments }}
+//	lower, upper, trim, replace, join
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/sapcc/netbox-webhook-distributor/pkg/filter"
+)
+
+var funcs = template.FuncMap{
+	"json":    toJSON,
+	"get":     filter.Lookup,
+	"default": defaultValue,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+	"join":    join,
+}
+
+// Template transforms the webhook json
+type Template struct {
+	tmpl *template.Template
+}
+
+// Parse parses a transform template
+func Parse(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("transform template: %s", err.Error())
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Execute renders the template with the webhook json
+func (t *Template) Execute(data []byte) ([]byte, error) {
+	var event map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as they are, ids would otherwise be rendered as floats
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		return nil, fmt.Errorf("transform decode event: %s", err.Error())
+	}
+	buf := bytes.Buffer{}
+	if err := t.tmpl.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("transform execute: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func defaultValue(fallback, v interface{}) interface{} {
+	if v == nil {
+		return fallback
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		if rv.Len() == 0 {
+			return fallback
+		}
+	}
+	return v
+}
+
+func join(sep string, v interface{}) string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	s := make([]string, 0, len(list))
+	for _, l := range list {
+		s = append(s, fmt.Sprint(l))
+	}
+	return strings.Join(s, sep)
+}